@@ -0,0 +1,153 @@
+// Package ctrkv reads the length-prefixed key/value files that hold the ctr
+// data, such as ./data/ctr_url_kv and ./data/vu_vd. Each record is
+//
+//	key_len   uint64
+//	key       [key_len]byte
+//	value_len uint64
+//	value     [value_len]byte    // serialized CtrInfo protobuf
+//
+// and records follow each other up to the end of the file, integers in BYTE_ORDER.
+package ctrkv
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	LEN_SIZE = 8
+	// lengths above these limits are treated as corruption instead of being allocated
+	MAX_KEY_LEN   = uint64(64 * 1024)
+	MAX_VALUE_LEN = uint64(64 * 1024 * 1024)
+)
+
+// BYTE_ORDER is the byte order of the length prefixes
+var BYTE_ORDER binary.ByteOrder = binary.LittleEndian
+
+var (
+	ErrTruncated = errors.New("truncated")
+	ErrTooLarge  = errors.New("length too large")
+)
+
+// FormatError describes a record that cannot be read, Err is ErrTruncated or ErrTooLarge
+type FormatError struct {
+	Offset int64
+	Err    error
+	Reason string
+}
+
+func (e *FormatError) Error() string {
+	return fmt.Sprintf("ctrkv: %v record at offset %d: %s", e.Err, e.Offset, e.Reason)
+}
+
+func (e *FormatError) Unwrap() error {
+	return e.Err
+}
+
+// Reader reads one record at a time, it is used like a bufio.Scanner:
+//
+//	reader := ctrkv.NewReader(fr)
+//	for reader.Next() {
+//		use(reader.Key(), reader.Value())
+//	}
+//	if err := reader.Err(); err != nil {
+//		...
+//	}
+type Reader struct {
+	r           *bufio.Reader
+	offset      int64
+	recordStart int64
+	key         []byte
+	value       []byte
+	err         error
+	MaxKeyLen   uint64
+	MaxValueLen uint64
+}
+
+// NewReader returns a Reader of the records in r
+func NewReader(r io.Reader) *Reader {
+	return &Reader{
+		r:           bufio.NewReader(r),
+		MaxKeyLen:   MAX_KEY_LEN,
+		MaxValueLen: MAX_VALUE_LEN,
+	}
+}
+
+// Next reads the next record, it returns false at the end of the input or on error
+func (reader *Reader) Next() bool {
+	if reader.err != nil {
+		return false
+	}
+	reader.recordStart = reader.offset
+	key, err := reader.readField("key", reader.MaxKeyLen, true)
+	if err != nil {
+		reader.err = err
+		return false
+	}
+	value, err := reader.readField("value", reader.MaxValueLen, false)
+	if err != nil {
+		reader.err = err
+		return false
+	}
+	reader.key, reader.value = key, value
+	return true
+}
+
+// read one length-prefixed field, a clean end of input is only allowed before a key
+func (reader *Reader) readField(name string, maxLen uint64, atRecordStart bool) ([]byte, error) {
+	lenBuf := make([]byte, LEN_SIZE)
+	n, err := io.ReadFull(reader.r, lenBuf)
+	reader.offset += int64(n)
+	if err == io.EOF && atRecordStart {
+		return nil, io.EOF
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, &FormatError{Offset: reader.recordStart, Err: ErrTruncated,
+			Reason: fmt.Sprintf("%s_len cut short at offset %d", name, reader.offset)}
+	}
+	if err != nil {
+		return nil, err
+	}
+	fieldLen := BYTE_ORDER.Uint64(lenBuf)
+	if fieldLen > maxLen {
+		return nil, &FormatError{Offset: reader.recordStart, Err: ErrTooLarge,
+			Reason: fmt.Sprintf("%s_len %d exceeds the limit %d", name, fieldLen, maxLen)}
+	}
+	field := make([]byte, fieldLen)
+	n, err = io.ReadFull(reader.r, field)
+	reader.offset += int64(n)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, &FormatError{Offset: reader.recordStart, Err: ErrTruncated,
+			Reason: fmt.Sprintf("%s needs %d bytes, only %d left", name, fieldLen, n)}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return field, nil
+}
+
+// Key returns the key of the current record, the slice is not reused by later calls
+func (reader *Reader) Key() []byte {
+	return reader.key
+}
+
+// Value returns the value of the current record, the slice is not reused by later calls
+func (reader *Reader) Value() []byte {
+	return reader.value
+}
+
+// Offset returns the byte offset of the current record
+func (reader *Reader) Offset() int64 {
+	return reader.recordStart
+}
+
+// Err returns the first error met by Next, the end of the input is not an error
+func (reader *Reader) Err() error {
+	if reader.err == io.EOF {
+		return nil
+	}
+	return reader.err
+}
@@ -0,0 +1,103 @@
+package ctrkv
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// count records, record i has key "key<i>" and a value of i bytes
+func encodeRecords(count int) []byte {
+	var buf []byte
+	field := make([]byte, LEN_SIZE)
+	for index := 0; index < count; index++ {
+		key := fmt.Sprintf("key%d", index)
+		BYTE_ORDER.PutUint64(field, uint64(len(key)))
+		buf = append(append(buf, field...), key...)
+		BYTE_ORDER.PutUint64(field, uint64(index))
+		buf = append(append(buf, field...), bytes.Repeat([]byte{byte(index)}, index)...)
+	}
+	return buf
+}
+
+func TestRoundTrip(t *testing.T) {
+	reader := NewReader(bytes.NewReader(encodeRecords(5)))
+	offset := int64(0)
+	count := 0
+	for reader.Next() {
+		if key := string(reader.Key()); key != fmt.Sprintf("key%d", count) {
+			t.Fatalf("record %d has key %s", count, key)
+		}
+		if !bytes.Equal(reader.Value(), bytes.Repeat([]byte{byte(count)}, count)) {
+			t.Fatalf("record %d has value %x", count, reader.Value())
+		}
+		if reader.Offset() != offset {
+			t.Fatalf("record %d at offset %d, want %d", count, reader.Offset(), offset)
+		}
+		offset += int64(LEN_SIZE*2 + len(reader.Key()) + len(reader.Value()))
+		count++
+	}
+	if err := reader.Err(); err != nil || count != 5 {
+		t.Fatalf("read %d records, err %v", count, err)
+	}
+}
+
+func TestTruncated(t *testing.T) {
+	buf := encodeRecords(3)
+	// the record boundaries are the only clean ends
+	boundaries := map[int]bool{}
+	for index := 0; index <= 3; index++ {
+		boundaries[len(encodeRecords(index))] = true
+	}
+	for size := 0; size < len(buf); size++ {
+		reader := NewReader(bytes.NewReader(buf[:size]))
+		for reader.Next() {
+		}
+		err := reader.Err()
+		if boundaries[size] {
+			if err != nil {
+				t.Fatalf("cut to %d bytes at a record boundary: %v", size, err)
+			}
+			continue
+		}
+		var formatErr *FormatError
+		if !errors.Is(err, ErrTruncated) || !errors.As(err, &formatErr) {
+			t.Fatalf("cut to %d bytes: %v, want ErrTruncated", size, err)
+		}
+	}
+}
+
+func TestTooLarge(t *testing.T) {
+	tests := []struct {
+		name  string
+		field int
+		value uint64
+	}{
+		{"key_len", 0, MAX_KEY_LEN + 1},
+		{"value_len", LEN_SIZE + 4, MAX_VALUE_LEN + 1},
+		{"huge key_len", 0, ^uint64(0)},
+		{"huge value_len", LEN_SIZE + 4, ^uint64(0)},
+	}
+	for _, test := range tests {
+		buf := encodeRecords(2)
+		BYTE_ORDER.PutUint64(buf[test.field:], test.value)
+		reader := NewReader(bytes.NewReader(buf))
+		if reader.Next() {
+			t.Fatalf("%s: read a record", test.name)
+		}
+		var formatErr *FormatError
+		if err := reader.Err(); !errors.Is(err, ErrTooLarge) || !errors.As(err, &formatErr) || formatErr.Offset != 0 {
+			t.Fatalf("%s: %v, want ErrTooLarge at offset 0", test.name, err)
+		}
+	}
+
+	// the limits are per reader
+	reader := NewReader(bytes.NewReader(encodeRecords(3)))
+	reader.MaxValueLen = 1
+	for reader.Next() {
+	}
+	if err := reader.Err(); !errors.Is(err, ErrTooLarge) || reader.Offset() == 0 {
+		t.Fatalf("MaxValueLen 1: %v at offset %d", err, reader.Offset())
+	}
+}
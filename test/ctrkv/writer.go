@@ -0,0 +1,55 @@
+package ctrkv
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+)
+
+// Writer appends records in the layout read by Reader
+type Writer struct {
+	w       *bufio.Writer
+	records int64
+}
+
+// NewWriter returns a Writer of records to w, call Flush when done
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: bufio.NewWriter(w)}
+}
+
+// Write appends one record
+func (writer *Writer) Write(key, value []byte) error {
+	if uint64(len(key)) > MAX_KEY_LEN {
+		return fmt.Errorf("ctrkv: key_len %d exceeds the limit %d", len(key), MAX_KEY_LEN)
+	}
+	if uint64(len(value)) > MAX_VALUE_LEN {
+		return fmt.Errorf("ctrkv: value_len %d exceeds the limit %d", len(value), MAX_VALUE_LEN)
+	}
+	lenBuf := make([]byte, LEN_SIZE)
+	BYTE_ORDER.PutUint64(lenBuf, uint64(len(key)))
+	if _, err := writer.w.Write(lenBuf); err != nil {
+		return err
+	}
+	if _, err := writer.w.Write(key); err != nil {
+		return err
+	}
+	BYTE_ORDER.PutUint64(lenBuf, uint64(len(value)))
+	if _, err := writer.w.Write(lenBuf); err != nil {
+		return err
+	}
+	if _, err := writer.w.Write(value); err != nil {
+		return err
+	}
+	writer.records++
+	return nil
+}
+
+// Records returns the number of records written so far
+func (writer *Writer) Records() int64 {
+	return writer.records
+}
+
+// Flush writes any buffered data to the underlying writer
+func (writer *Writer) Flush() error {
+	return writer.w.Flush()
+}
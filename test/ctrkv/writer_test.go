@@ -0,0 +1,33 @@
+package ctrkv
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestWriter(t *testing.T) {
+	var buf bytes.Buffer
+	writer := NewWriter(&buf)
+	for index := 0; index < 5; index++ {
+		if err := writer.Write([]byte(fmt.Sprintf("key%d", index)), bytes.Repeat([]byte{byte(index)}, index)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if writer.Records() != 5 {
+		t.Fatalf("Records = %d, want 5", writer.Records())
+	}
+	if !bytes.Equal(buf.Bytes(), encodeRecords(5)) {
+		t.Fatalf("wrote %x, want %x", buf.Bytes(), encodeRecords(5))
+	}
+
+	if err := writer.Write(make([]byte, MAX_KEY_LEN+1), nil); err == nil {
+		t.Fatal("Write accepted an oversized key")
+	}
+	if writer.Records() != 5 {
+		t.Fatalf("a rejected record was counted, Records = %d", writer.Records())
+	}
+}
@@ -2,18 +2,32 @@ package main
 
 import (
 	"bufio"
+	"container/heap"
+	"context"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
-	"io/ioutil"
+	"hash/fnv"
+	"io"
 	"math"
 	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
 	"sort"
 	"strconv"
 	"strings"
-	"unsafe"
+	"sync"
+	"text/tabwriter"
+	"time"
+	"write_index/ctrkv"
 	ctrintpb "write_index/protobuf/ctrint_reduce"
 	ctrstrpb "write_index/protobuf/ctrstr_reduce"
+	"write_index/scoreexpr"
+	"write_index/simhash"
+	"write_index/topicindex"
 
 	"github.com/golang/protobuf/proto"
 )
@@ -25,17 +39,49 @@ const (
 	UINT64_SIZE   = uint32(8)
 	FLOAT64_SIZE  = uint32(8)
 	DOC_ITEM_SIZE = UINT64_SIZE + UINT8_SIZE
-	N             = int(unsafe.Sizeof(0))
 	TOPIC_ALL_8   = uint64(1111)
 	MINIMAL_VIDS  = int(1)
 	CTR_VP_PREFIX = string("vu_")
+	MAX_LINE_SIZE = 64 * 1024 * 1024
+	// loaders look for cancellation once per this many records
+	CANCEL_CHECK_INTERVAL = 1024
+	// a list longer than this many times its max length is cut with a heap instead of a full sort
+	TOP_K_HEAP_RATIO = 4
+
+	// list types the build command can write, every other list type is the name of a Scorer
+	LIST_TYPE_ALL   = "all"
+	LIST_TYPE_HOT   = "hot"
+	LIST_TYPE_NEW   = "new"
+	LIST_TYPE_CTR   = "ctr"
+	LIST_TYPE_TREND = "trend"
+
+	// smoothing of the click-through rate of the ctr list
+	CTR_METHOD_BAYES  = "bayes"
+	CTR_METHOD_WILSON = "wilson"
+	// ctr lists sort by the smoothed rate times CTR_SCORE_SCALE
+	CTR_SCORE_SCALE = 1e9
+	// trend lists sort by the decayed engagement times TREND_SCORE_SCALE
+	TREND_SCORE_SCALE = 1e3
+
+	// spacing of the weight buckets
+	WEIGHT_SCALE_LINEAR = "linear"
+	WEIGHT_SCALE_LOG    = "log"
+
+	// a sharded dump is <output>.shard<i> plus the manifest <output>.manifest
+	SHARD_FILE_SUFFIX = ".shard"
+	MANIFEST_SUFFIX   = ".manifest"
+
+	// exit codes of the commands
+	EXIT_OK      = 0
+	EXIT_FAILURE = 1
+	EXIT_USAGE   = 2
 )
 
-type DocItem struct {
-	Vid     uint64
-	Weight  uint8
-	SortVal uint64
-}
+// LIST_TYPES are what the build command writes without -lists, newer list types are opt-in
+var LIST_TYPES = []string{LIST_TYPE_ALL, LIST_TYPE_HOT, LIST_TYPE_NEW}
+
+// DocItem is shared with the topicindex reader so both sides agree on the record
+type DocItem = topicindex.DocItem
 
 type MicroVideoItem struct {
 	Title       string `json:"title"`
@@ -57,6 +103,8 @@ type TopicItem struct {
 type TopicIndexItem struct {
 	Title   string
 	DocList []*DocItem
+	// length of DocList before it was cut to the max length of its list type, 0 when it was not cut
+	Total int
 }
 
 type ByScoreDescending []*DocItem
@@ -113,531 +161,2978 @@ func (items ByWeightAscending) Less(i, j int) bool {
 	return items[i].Weight < items[j].Weight
 }
 
-func choose() binary.ByteOrder {
-	x := 0x1234
-	p := unsafe.Pointer(&x)
-	p2 := (*[N]byte)(p)
-	if p2[0] == 0 {
-		return binary.BigEndian
-	} else {
-		return binary.LittleEndian
+// ScoreInput is what a Scorer knows about one vid of a topic
+type ScoreInput struct {
+	Vid   uint64
+	Video *MicroVideoItem
+	// unix seconds the build runs at, the same for every vid of a build
+	BuildTime int64
+	// nil when the vid has no vote up ctr
+	VoteUp *ctrstrpb.CtrInfo
+	// nil when the vid has no ctr in the ctr file keyed by uint64
+	CtrInt *ctrintpb.CtrInfo
+}
+
+// Age is how long before the build the video was published, 0 for a publish time
+// in the future
+func (input *ScoreInput) Age() time.Duration {
+	age := input.BuildTime - int64(input.Video.PublishTime)
+	if input.Video.PublishTime > math.MaxInt64 || age < 0 {
+		return 0
 	}
+	return time.Duration(age) * time.Second
 }
 
-var ByteOrder binary.ByteOrder = choose()
-var MicroVideoReshape map[uint64]MicroVideoItem = make(map[uint64]MicroVideoItem, 0)
-var TopicHotReshape map[uint64]*TopicIndexItem = make(map[uint64]*TopicIndexItem, 0)
-var TopicTimeReshape map[uint64]*TopicIndexItem = make(map[uint64]*TopicIndexItem, 0)
-var TopicReshape map[uint64]*TopicIndexItem = make(map[uint64]*TopicIndexItem, 0)
-var CtrVoteUpReshape map[string]*ctrstrpb.CtrInfo = make(map[string]*ctrstrpb.CtrInfo, 0)
-var CtrIntReshape map[uint64]*ctrintpb.CtrInfo = make(map[uint64]*ctrintpb.CtrInfo, 0)
+// Scorer orders one list type, every topic gets a list under the key
+// TOPIC_<id><KeySuffix> sorted by Score descending
+type Scorer interface {
+	// name of the list type, as given to build -lists
+	Name() string
+	KeySuffix() string
+	Score(input *ScoreInput) uint64
+	Weight(input *ScoreInput) uint8
+}
 
-// read Topic data from file
-func LoadTopicData(FileName string,
-	MicroVideoReshape map[uint64]MicroVideoItem,
-	TopicTimeReshape map[uint64]*TopicIndexItem,
-	TopicHotReshape map[uint64]*TopicIndexItem,
-	TopicReshape map[uint64]*TopicIndexItem,
-	CtrIntReshape map[uint64]*ctrintpb.CtrInfo,
-	CtrVoteUpReshape map[string]*ctrstrpb.CtrInfo) {
-	fr, err := os.Open(FileName)
-	Check(err)
-	defer func() {
-		if err := fr.Close(); err != nil {
-			fmt.Println("close filename %s failed", FileName)
-		}
-	}()
-	scanner := bufio.NewScanner(bufio.NewReader(fr))
+// BuildTimeScorer is implemented by a Scorer whose Score or Weight may read
+// ScoreInput.BuildTime, its lists go stale as the clock moves
+type BuildTimeScorer interface {
+	UsesBuildTime() bool
+}
 
-	var itemIndex TopicIndexItem
-	for scanner.Scan() {
-		var itemEle TopicItem
-		if err := json.Unmarshal(scanner.Bytes(), &itemEle); err != nil {
-			err = fmt.Errorf("Unmarshal Topic data error: %v", err)
-			fmt.Fprintln(os.Stderr, err)
-		} else {
-			var itemIndexForTime TopicIndexItem
-			var itemIndexForHot TopicIndexItem
+// whether the lists of scorer depend on the build time
+func usesBuildTime(scorer Scorer) bool {
+	timed, ok := scorer.(BuildTimeScorer)
+	return ok && timed.UsesBuildTime()
+}
 
-			topicId, err := strconv.ParseUint(itemEle.TopicId, 10, 64)
-			if err != nil {
-				err = fmt.Errorf("parse Topic topicid from string to uint64 error, topicid is %s, and err is %v", itemEle.TopicId, err)
-				fmt.Println(err)
-				continue
-			}
+// FuncScorer builds a Scorer from two functions
+type FuncScorer struct {
+	ScorerName string
+	Suffix     string
+	ScoreFunc  func(input *ScoreInput) uint64
+	WeightFunc func(input *ScoreInput) uint8
+}
 
-			itemIndexForTime.Title = itemEle.Title
-			itemIndexForHot.Title = itemEle.Title
-			var filterRepeatVid map[uint64]bool = make(map[uint64]bool, 0)
-			for _, itemStr := range itemEle.VidList {
-				item, err := strconv.ParseUint(itemStr, 10, 64)
-				if err != nil {
-					err = fmt.Errorf("parse Topic VidList.vid from string to uint64 error, vid is %s, and err is %v", itemStr, err)
-					fmt.Println(err)
-					continue
-				}
-				if _, ok := filterRepeatVid[item]; ok {
-					fmt.Printf("vid %d already exists\n", item)
-					continue
-				} else {
-					filterRepeatVid[item] = true
-				}
+func (scorer *FuncScorer) Name() string {
+	return scorer.ScorerName
+}
 
-				var SortTime, SortHot uint64 = 0, 0
-				var weightTime, weightHot uint8 = 0, 0
-				// search MicroVideoData map[uint64]MicroVideoItem
-				videoItem, ok := MicroVideoReshape[item]
-				if ok {
-
-					CtrVpVidKey := CTR_VP_PREFIX + itemStr
-					if CtrVpVal, ok := CtrVoteUpReshape[CtrVpVidKey]; ok {
-						// call the computer score function
-						SortTime = videoItem.ComputeScoreForTime(CtrVpVal)
-						SortHot = videoItem.ComputeScoreForHot(CtrVpVal)
-					} else {
-						fmt.Printf("the vid %v doesnot exist in ctr_string\n", item)
-					}
-					// compute weight
-					weightTime = videoItem.ComputeWeightForTime()
-					weightHot = videoItem.ComputeWeightForHot()
-				} else {
-					fmt.Printf("the vid %v doesnot exist in json library\n", item)
-					continue
-				}
-				// storage the vid and weight
-				itemIndexForTime.DocList = append(itemIndexForTime.DocList,
-					&DocItem{Vid: item, Weight: weightTime, SortVal: SortTime})
-				itemIndexForHot.DocList = append(itemIndexForHot.DocList,
-					&DocItem{Vid: item, Weight: weightHot, SortVal: SortHot})
-			}
-			if len(itemIndexForHot.DocList) < MINIMAL_VIDS {
-				continue
-			}
-			// according to Weight to sort DocList slice
-			sort.Sort(ByScoreDescending(itemIndexForTime.DocList))
-			sort.Sort(ByScoreDescending(itemIndexForHot.DocList))
+func (scorer *FuncScorer) KeySuffix() string {
+	return scorer.Suffix
+}
 
-			weight := uint8(0)
-			sortVal := uint64(0)
-			itemIndex.DocList = append(itemIndex.DocList, &DocItem{
-				Vid: topicId, Weight: weight, SortVal: sortVal})
-			TopicTimeReshape[topicId] = &itemIndexForTime
-			TopicHotReshape[topicId] = &itemIndexForHot
-		}
-	}
-	TopicReshape[TOPIC_ALL_8] = &itemIndex
-	if err := scanner.Err(); err != nil {
-		fmt.Fprintln(os.Stderr, "reading standard input:", err)
-	}
+func (scorer *FuncScorer) Score(input *ScoreInput) uint64 {
+	return scorer.ScoreFunc(input)
 }
 
-// compute weight by shift bytes
-func (MicroVideoItem *MicroVideoItem) ComputeScoreForTime(CtrVpVal *ctrstrpb.CtrInfo) uint64 {
-	var weight uint64 = MicroVideoItem.PublishTime
-	return weight
+func (scorer *FuncScorer) Weight(input *ScoreInput) uint8 {
+	if scorer.WeightFunc == nil {
+		return 0
+	}
+	return scorer.WeightFunc(input)
 }
 
-// compute weight by shift bytes
-func (MicroVideoItem *MicroVideoItem) ComputeWeightForTime() uint8 {
-	publishTime := MicroVideoItem.PublishTime
-	var weight uint8 = 0
-	for index := 7; index >= 0; index-- {
-		shiftIndex, err := Int8ToUint8(int8(index))
-		if err != nil {
-			continue
+// registered scorers by name, scorerNames keeps the registration order
+var scorerRegistry map[string]Scorer = make(map[string]Scorer, 0)
+var scorerNames []string
+
+// RegisterScorer makes a list type available to the build command
+func RegisterScorer(scorer Scorer) error {
+	name := scorer.Name()
+	if name == "" || name == LIST_TYPE_ALL || strings.Contains(name, ",") {
+		return fmt.Errorf("invalid scorer name %q", name)
+	}
+	if _, ok := scorerRegistry[name]; ok {
+		return fmt.Errorf("scorer %s is already registered", name)
+	}
+	suffix := scorer.KeySuffix()
+	if !strings.HasPrefix(suffix, "_") {
+		return fmt.Errorf("key suffix %q of scorer %s must start with _", suffix, name)
+	}
+	for _, registered := range scorerRegistry {
+		if registered.KeySuffix() == suffix {
+			return fmt.Errorf("key suffix %s of scorer %s is already used by scorer %s", suffix, name, registered.Name())
 		}
-		shiftBits := shiftIndex * 8
-		if tmp_byte := (publishTime >> shiftBits) & 0xff; tmp_byte != 0 {
-			weight |= (0x01) << shiftIndex
+	}
+	scorerRegistry[name] = scorer
+	scorerNames = append(scorerNames, name)
+	return nil
+}
+
+// ReplaceScorer registers scorer, or swaps it in for the scorer registered under its name
+func ReplaceScorer(scorer Scorer) error {
+	name := scorer.Name()
+	registered, ok := scorerRegistry[name]
+	if !ok {
+		return RegisterScorer(scorer)
+	}
+	suffix := scorer.KeySuffix()
+	if !strings.HasPrefix(suffix, "_") {
+		return fmt.Errorf("key suffix %q of scorer %s must start with _", suffix, name)
+	}
+	for _, other := range scorerRegistry {
+		if other != registered && other.KeySuffix() == suffix {
+			return fmt.Errorf("key suffix %s of scorer %s is already used by scorer %s", suffix, name, other.Name())
 		}
 	}
-	return weight
+	scorerRegistry[name] = scorer
+	return nil
 }
 
-// compute weight by shift bytes
-func (MicroVideoItem *MicroVideoItem) ComputeScoreForHot(CtrVpVal *ctrstrpb.CtrInfo) uint64 {
-	return uint64(*CtrVpVal.Click)
+// LookupScorer returns the scorer registered under name
+func LookupScorer(name string) (Scorer, bool) {
+	scorer, ok := scorerRegistry[name]
+	return scorer, ok
 }
 
-// compute weight by shift bytes
-func (MicroVideoItem *MicroVideoItem) ComputeWeightForHot() uint8 {
-	mthid, err := strconv.ParseUint(MicroVideoItem.Mthid, 10, 64)
-	if err != nil {
-		err = fmt.Errorf("parse MicroVideoData.mthid from string to uint64 error, vid is %s, and err is %v", MicroVideoItem.Mthid, err)
-		fmt.Println(err)
-		mthid = 0
-	}
+// ScorerNames returns the names of the registered scorers in registration order
+func ScorerNames() []string {
+	return append([]string(nil), scorerNames...)
+}
 
-	playCnt, commentCnt := MicroVideoItem.PlayCnt, MicroVideoItem.CommentCnt
-	var weight uint8 = 0
-	for index := 7; index >= 0; index-- {
-		shiftIndex, err := Int8ToUint8(int8(index))
-		if err != nil {
+// every list type the build command can write
+func listTypeNames() []string {
+	return append([]string{LIST_TYPE_ALL}, ScorerNames()...)
+}
+
+func init() {
+	// as before the scorers existed, a vid without vote up ctr scores 0 in both lists
+	Check(RegisterScorer(&FuncScorer{
+		ScorerName: LIST_TYPE_HOT,
+		Suffix:     topicindex.HOT_SUFFIX,
+		ScoreFunc: func(input *ScoreInput) uint64 {
+			if input.VoteUp == nil {
+				return 0
+			}
+			return input.Video.ComputeScoreForHot(input.VoteUp)
+		},
+		WeightFunc: func(input *ScoreInput) uint8 {
+			return input.Video.ComputeWeightForHot()
+		},
+	}))
+	Check(RegisterScorer(&FuncScorer{
+		ScorerName: LIST_TYPE_NEW,
+		Suffix:     topicindex.NEW_SUFFIX,
+		ScoreFunc: func(input *ScoreInput) uint64 {
+			if input.VoteUp == nil {
+				return 0
+			}
+			return input.Video.ComputeScoreForTime(input.VoteUp)
+		},
+		WeightFunc: func(input *ScoreInput) uint8 {
+			return input.Video.ComputeWeightForTime()
+		},
+	}))
+	Check(RegisterScorer(DefaultCtrScorer()))
+	Check(RegisterScorer(DefaultTrendScorer()))
+}
+
+// variables of a score expression taken from the MicroVideoItem, the ctr fields
+// follow: every numeric field of the vote up CtrInfo under its own name and every
+// numeric field of the uint64 keyed CtrInfo prefixed with CTR_INT_VAR_PREFIX
+var VIDEO_SCORE_VARIABLES = []string{"PlayCnt", "CommentCnt", "PublishTime", "Age", "HasVoteUp", "HasCtrInt"}
+
+const CTR_INT_VAR_PREFIX = "CtrInt"
+
+// the score variable computed from ScoreInput.BuildTime
+const BUILD_TIME_VARIABLE = "Age"
+
+// a numeric field of a CtrInfo struct usable in a score expression
+type ctrField struct {
+	Name  string
+	Index int
+}
+
+var voteUpCtrFields = numericFields(reflect.TypeOf(ctrstrpb.CtrInfo{}))
+var ctrIntCtrFields = numericFields(reflect.TypeOf(ctrintpb.CtrInfo{}))
+
+// the exported numeric fields of a generated message, optional fields are pointers
+func numericFields(structType reflect.Type) []ctrField {
+	var fields []ctrField
+	for index := 0; index < structType.NumField(); index++ {
+		field := structType.Field(index)
+		if field.PkgPath != "" || strings.HasPrefix(field.Name, "XXX_") {
 			continue
 		}
-		shiftBits := shiftIndex * 8
-		if tmp_byte := ((mthid >> shiftBits) | (playCnt >> shiftBits) | (commentCnt >> shiftBits)) & 0xff; tmp_byte != 0 {
-			weight |= (0x01) << shiftIndex
+		fieldType := field.Type
+		if fieldType.Kind() == reflect.Ptr {
+			fieldType = fieldType.Elem()
+		}
+		switch fieldType.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+			reflect.Float32, reflect.Float64:
+			fields = append(fields, ctrField{Name: field.Name, Index: index})
 		}
 	}
-	return weight
+	return fields
 }
 
-// read MicroVideoDat from file whose format is json
-func LoadMicroVideoData(FileName string, MicroVideoReshape map[uint64]MicroVideoItem) {
-	fr, err := os.Open(FileName)
-	Check(err)
-	defer func() {
-		if err := fr.Close(); err != nil {
-			fmt.Println("close filename %s failed", FileName)
+// append the fields of message to values, unset fields and a nil message count as 0
+func appendFieldValues(values []float64, fields []ctrField, message interface{}) []float64 {
+	structValue := reflect.ValueOf(message)
+	if structValue.IsNil() {
+		for range fields {
+			values = append(values, 0)
 		}
-	}()
-	scanner := bufio.NewScanner(bufio.NewReader(fr))
-	for scanner.Scan() {
-		var mvItem MicroVideoItem
-		if err := json.Unmarshal(scanner.Bytes(), &mvItem); err != nil {
-			err = fmt.Errorf("Unmarshal MicroVideo data error: %v", err)
-			fmt.Println(err)
-		} else {
-			vid, err := strconv.ParseUint(mvItem.Vid, 10, 64)
-			if err != nil {
-				err = fmt.Errorf("parse vid from string to uint64 error, vid is %s, and err is %v", mvItem.Vid, err)
-				fmt.Println(err)
+		return values
+	}
+	structValue = structValue.Elem()
+	for _, field := range fields {
+		fieldValue := structValue.Field(field.Index)
+		if fieldValue.Kind() == reflect.Ptr {
+			if fieldValue.IsNil() {
+				values = append(values, 0)
 				continue
-
 			}
-			MicroVideoReshape[vid] = mvItem
+			fieldValue = fieldValue.Elem()
+		}
+		switch fieldValue.Kind() {
+		case reflect.Float32, reflect.Float64:
+			values = append(values, fieldValue.Float())
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			values = append(values, float64(fieldValue.Uint()))
+		default:
+			values = append(values, float64(fieldValue.Int()))
 		}
 	}
-	if err := scanner.Err(); err != nil {
-		fmt.Fprintln(os.Stderr, "reading standard input:", err)
+	return values
+}
+
+// ScoreVariables returns the names a score expression can use, in the order of scoreValues
+func ScoreVariables() []string {
+	names := append([]string(nil), VIDEO_SCORE_VARIABLES...)
+	for _, field := range voteUpCtrFields {
+		names = append(names, field.Name)
+	}
+	for _, field := range ctrIntCtrFields {
+		names = append(names, CTR_INT_VAR_PREFIX+field.Name)
 	}
+	return names
 }
 
-func Float32ToBytes(num float32) []byte {
-	bits := math.Float32bits(num)
-	bytes := make([]byte, 4)
-	ByteOrder.PutUint32(bytes, bits)
-	return bytes
+func boolToFloat64(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
 }
 
-func Float64ToBytes(num float64) []byte {
-	bits := math.Float64bits(num)
-	bytes := make([]byte, 8)
-	ByteOrder.PutUint64(bytes, bits)
-	return bytes
+// the values of ScoreVariables for one vid
+func scoreValues(input *ScoreInput) []float64 {
+	values := make([]float64, 0, len(VIDEO_SCORE_VARIABLES)+len(voteUpCtrFields)+len(ctrIntCtrFields))
+	values = append(values,
+		float64(input.Video.PlayCnt),
+		float64(input.Video.CommentCnt),
+		float64(input.Video.PublishTime),
+		input.Age().Seconds(),
+		boolToFloat64(input.VoteUp != nil),
+		boolToFloat64(input.CtrInt != nil))
+	values = appendFieldValues(values, voteUpCtrFields, input.VoteUp)
+	return appendFieldValues(values, ctrIntCtrFields, input.CtrInt)
 }
 
-func Uint8ToBytes(num uint8) []byte {
-	num_bytes := make([]byte, 1)
-	num_bytes[0] = byte(num)
-	return num_bytes
+// ExprScorer scores with expressions of the score config
+type ExprScorer struct {
+	ScorerName string
+	Suffix     string
+	ScoreExpr  *scoreexpr.Expr
+	// score is ScoreExpr * Scale rounded, negative and NaN scores become 0
+	Scale float64
+	// nil keeps the weight of WeightFrom, the scorer the config replaced
+	WeightExpr *scoreexpr.Expr
+	WeightFrom Scorer
 }
 
-func Uint32ToBytes(num uint32) []byte {
-	num_bytes := make([]byte, 4)
-	ByteOrder.PutUint32(num_bytes, num)
-	return num_bytes
+func (scorer *ExprScorer) Name() string {
+	return scorer.ScorerName
 }
 
-func Uint64ToBytes(num uint64) []byte {
-	num_bytes := make([]byte, 8)
-	ByteOrder.PutUint64(num_bytes, num)
-	return num_bytes
+func (scorer *ExprScorer) KeySuffix() string {
+	return scorer.Suffix
 }
 
-func BytesToFloat32(bytes []byte) float32 {
-	bits := ByteOrder.Uint32(bytes)
-	return math.Float32frombits(bits)
+func (scorer *ExprScorer) Score(input *ScoreInput) uint64 {
+	score := scorer.ScoreExpr.Eval(scoreValues(input)) * scorer.Scale
+	if !(score > 0) {
+		return 0
+	}
+	if score >= math.MaxUint64 {
+		return math.MaxUint64
+	}
+	return uint64(math.Round(score))
 }
 
-func BytesToFloat64(bytes []byte) float64 {
-	bits := ByteOrder.Uint64(bytes)
-	return math.Float64frombits(bits)
+func (scorer *ExprScorer) UsesBuildTime() bool {
+	if scorer.ScoreExpr.Uses(BUILD_TIME_VARIABLE) {
+		return true
+	}
+	if scorer.WeightExpr == nil {
+		return scorer.WeightFrom != nil && usesBuildTime(scorer.WeightFrom)
+	}
+	return scorer.WeightExpr.Uses(BUILD_TIME_VARIABLE)
+}
+
+func (scorer *ExprScorer) Weight(input *ScoreInput) uint8 {
+	if scorer.WeightExpr == nil {
+		if scorer.WeightFrom == nil {
+			return 0
+		}
+		return scorer.WeightFrom.Weight(input)
+	}
+	weight := scorer.WeightExpr.Eval(scoreValues(input))
+	if !(weight > 0) {
+		return 0
+	}
+	if weight >= math.MaxUint8 {
+		return math.MaxUint8
+	}
+	return uint8(math.Round(weight))
 }
 
-func BytesToUint32(bytes []byte) uint32 {
-	return ByteOrder.Uint32(bytes)
+// ScoreConfig is the json file given to build -config, for example
+//
+//	{"scorers": [
+//	  {"name": "hot", "score": "Click + log1p(PlayCnt)"},
+//	  {"name": "comment", "key_suffix": "_COMMENT_8", "score": "CommentCnt / (PlayCnt + 1)", "scale": 1000000}
+//	]}
+//
+// a scorer named like a registered one replaces it and keeps its key suffix and weight
+// unless the config sets them, any other name adds a list type
+type ScoreConfig struct {
+	Scorers []ScorerConfig `json:"scorers"`
 }
 
-func BytesToUint64(bytes []byte) uint64 {
-	return ByteOrder.Uint64(bytes)
+type ScorerConfig struct {
+	Name      string `json:"name"`
+	KeySuffix string `json:"key_suffix"`
+	Score     string `json:"score"`
+	// optional, the weight is clamped to [0, 255]
+	Weight string `json:"weight"`
+	// optional, 1 when unset
+	Scale *float64 `json:"scale"`
 }
 
-func Int8ToUint8(num int8) (uint8, error) {
-	var unum uint8 = 0
-	var err error = nil
-	var largeNum int64 = 0
-	if num < 0 {
-		largeNum -= int64(num)
-	} else {
-		largeNum = int64(num)
+// LoadScoreConfig reads FileName and registers its scorers, every expression is
+// checked before any scorer is registered
+func LoadScoreConfig(FileName string) error {
+	fr, err := os.Open(FileName)
+	if err != nil {
+		return fmt.Errorf("open score config error: %v", err)
 	}
-
-	tmpStr := strconv.FormatInt(largeNum, 10)
-	if largeUnum, err := strconv.ParseUint(tmpStr, 10, 64); err == nil {
-		unum = uint8(largeUnum)
-	} else {
-		err = fmt.Errorf("Int8 to Uint8 failed, input is %d, error is %v", num, err)
+	defer fr.Close()
+	decoder := json.NewDecoder(fr)
+	decoder.DisallowUnknownFields()
+	var config ScoreConfig
+	if err := decoder.Decode(&config); err != nil {
+		return fmt.Errorf("parse score config %s error: %v", FileName, err)
+	}
+	if len(config.Scorers) == 0 {
+		return fmt.Errorf("score config %s has no scorers", FileName)
 	}
-	return unum, err
 
-}
-func Int32ToUint32(num int32, base int) (uint32, error) {
-	var unum uint32 = 0
-	var err error = nil
-	if num >= 0 {
-		str := strconv.FormatInt(int64(num), base)
-		if unum64, err := strconv.ParseUint(str, base, 32); err == nil {
-			unum = uint32(unum64)
-		} else {
-			fmt.Println("str to uint32 error")
+	variables := ScoreVariables()
+	scorers := make([]*ExprScorer, 0, len(config.Scorers))
+	seen := make(map[string]bool, len(config.Scorers))
+	for index, entry := range config.Scorers {
+		if entry.Name == "" {
+			return fmt.Errorf("score config %s: scorer %d has no name", FileName, index)
 		}
-	} else {
-		err = fmt.Errorf("input value is negative whose value is:%s", num)
-		fmt.Println("input value is smaller than zero")
+		if seen[entry.Name] {
+			return fmt.Errorf("score config %s: scorer %s is defined twice", FileName, entry.Name)
+		}
+		seen[entry.Name] = true
+		scorer := &ExprScorer{ScorerName: entry.Name, Suffix: entry.KeySuffix, Scale: 1}
+		if registered, ok := LookupScorer(entry.Name); ok {
+			scorer.WeightFrom = registered
+			if scorer.Suffix == "" {
+				scorer.Suffix = registered.KeySuffix()
+			}
+		} else if scorer.Suffix == "" {
+			return fmt.Errorf("score config %s: new scorer %s needs a key_suffix", FileName, entry.Name)
+		}
+		if entry.Scale != nil {
+			if !(*entry.Scale > 0) || math.IsInf(*entry.Scale, 0) {
+				return fmt.Errorf("score config %s: scale of scorer %s must be a positive number, got %v", FileName, entry.Name, *entry.Scale)
+			}
+			scorer.Scale = *entry.Scale
+		}
+		if scorer.ScoreExpr, err = scoreexpr.Parse(entry.Score, variables); err != nil {
+			return fmt.Errorf("score config %s: score of scorer %s, %v", FileName, entry.Name, err)
+		}
+		if entry.Weight != "" {
+			if scorer.WeightExpr, err = scoreexpr.Parse(entry.Weight, variables); err != nil {
+				return fmt.Errorf("score config %s: weight of scorer %s, %v", FileName, entry.Name, err)
+			}
+		}
+		scorers = append(scorers, scorer)
 	}
-	return unum, err
-}
-
-func Int64ToUint64(num int64, base int) (uint64, error) {
-	var unum uint64 = 0
-	var err error = nil
-	if num >= 0 {
-		str := strconv.FormatInt(num, base)
-		if unum64, err := strconv.ParseUint(str, base, 64); err == nil {
-			unum = unum64
-		} else {
-			fmt.Println("str to uint64 error")
+	for _, scorer := range scorers {
+		if err := ReplaceScorer(scorer); err != nil {
+			return fmt.Errorf("score config %s: %v", FileName, err)
 		}
-	} else {
-		err = fmt.Errorf("input value is negative whose value is:%s", num)
-		fmt.Println("input value is smaller than zero")
 	}
-	return unum, err
+	return nil
 }
 
-func Uint64ToFloat64(num uint64, base int) (float64, error) {
-	var fnum float64 = 0
-	var err error = nil
-	num_str := strconv.FormatUint(num, base)
-	if fnum64, err := strconv.ParseFloat(num_str, base); err == nil {
-		fnum = fnum64
-	} else {
-		fmt.Println("str to float64 error")
-	}
-	return fnum, err
+// CtrScorer orders by the click-through rate of the ctr keyed by uint64, smoothed so
+// a few lucky shows do not outrank a long record
+type CtrScorer struct {
+	// CTR_METHOD_BAYES or CTR_METHOD_WILSON
+	Method string
+	// rate expected without any data
+	PriorMean float64
+	// how many shows the prior is worth, wilson bounds a vid without ctr by
+	// PriorMean*PriorShows clicks in PriorShows shows
+	PriorShows float64
+	// wilson only, z-score of the confidence of the lower bound
+	Z float64
 }
 
-func Check(e error) {
-	if e != nil {
-		panic(e)
-	}
+// DefaultCtrScorer is the ctr list type before any build flag
+func DefaultCtrScorer() *CtrScorer {
+	return &CtrScorer{Method: CTR_METHOD_BAYES, PriorMean: 0.05, PriorShows: 100, Z: 1.96}
 }
 
-func WriteIndexDataToFile(buf_fw *bufio.Writer, key []byte, DocItemList []*DocItem) error {
-	// get bytes length whose type is uint32
-	var err error = nil
-	key_len, err := Int32ToUint32(int32(len(key)), 10)
-	if err != nil {
-		err = fmt.Errorf("change key's length to uint32 failed, key is %s, error is %v", key, err)
-		return err
+// Validate reports the first setting the rates cannot be computed with
+func (scorer *CtrScorer) Validate() error {
+	if scorer.Method != CTR_METHOD_BAYES && scorer.Method != CTR_METHOD_WILSON {
+		return fmt.Errorf("unknown ctr method %q, expect %s or %s", scorer.Method, CTR_METHOD_BAYES, CTR_METHOD_WILSON)
 	}
-	if len_w, err := buf_fw.Write(Uint32ToBytes(key_len)); err != nil {
-		err = fmt.Errorf("key_len write value error, key is %s, error is %v", key, err)
-		return err
-	} else {
-		fmt.Printf("key_len write %d bytes successfully\n", len_w)
+	if !(scorer.PriorMean > 0 && scorer.PriorMean < 1) {
+		return fmt.Errorf("ctr prior mean must be in (0, 1), got %v", scorer.PriorMean)
 	}
-	if len_w, err := buf_fw.Write(key); err != nil {
-		err = fmt.Errorf("key write value error, key is %s, error is %v", key, err)
-		return err
-	} else {
-		fmt.Printf("key write %d bytes\n", len_w)
+	if !(scorer.PriorShows >= 0) || math.IsInf(scorer.PriorShows, 0) {
+		return fmt.Errorf("ctr prior shows must not be negative, got %v", scorer.PriorShows)
 	}
-
-	len_tmp, err := Int32ToUint32(int32(len(DocItemList)), 10)
-	if err != nil {
-		err = fmt.Errorf("change DocItemList's size failed, size is %d, error is%v", len(DocItemList), err)
-		return err
+	if !(scorer.Z > 0) || math.IsInf(scorer.Z, 0) {
+		return fmt.Errorf("ctr z must be positive, got %v", scorer.Z)
 	}
+	return nil
+}
 
-	len_list := len_tmp * DOC_ITEM_SIZE
-	if len_w, err := buf_fw.Write(Uint32ToBytes(len_list)); err != nil {
-		err = fmt.Errorf("list len write value error, size is %d, error is%v", len_list, err)
-		return err
-	} else {
-		fmt.Printf("list len write %d bytes value is %v\n", len_w, len_list)
-	}
+func (scorer *CtrScorer) Name() string {
+	return LIST_TYPE_CTR
+}
 
-	for _, DocItemEle := range DocItemList {
-		// fmt.Printf("insert DocItem value is: %T\n", ele.Value)
+func (scorer *CtrScorer) KeySuffix() string {
+	return topicindex.CTR_SUFFIX
+}
 
-		vid := DocItemEle.Vid
-		if len_w, err := buf_fw.Write(Uint64ToBytes(vid)); err != nil {
-			fmt.Printf("key write value error %v\n", err)
-			continue
-		} else {
-			fmt.Printf("key write %d bytes\n", len_w)
-		}
-		weight := DocItemEle.Weight
-		if len_w, err := buf_fw.Write(Uint8ToBytes(weight)); err != nil {
-			fmt.Printf("weight write value error %v\n", err)
-		} else {
-			fmt.Printf("weight write %d bytes\n", len_w)
+// Rate returns the smoothed click-through rate in [0, 1]
+func (scorer *CtrScorer) Rate(CtrIntVal *ctrintpb.CtrInfo) float64 {
+	if CtrIntVal == nil {
+		return scorer.priorRate()
+	}
+	click, show := float64(CtrIntVal.GetClick()), float64(CtrIntVal.GetShow())
+	if click < 0 || show < 0 {
+		return scorer.priorRate()
+	}
+	// a click without a logged show still counts as shown
+	if click > show {
+		show = click
+	}
+	if scorer.Method == CTR_METHOD_WILSON {
+		if show == 0 {
+			return scorer.priorRate()
 		}
+		return wilsonLowerBound(click, show, scorer.Z)
 	}
-	return err
+	// posterior mean of Beta(PriorMean*PriorShows, (1-PriorMean)*PriorShows)
+	if show+scorer.PriorShows == 0 {
+		return scorer.PriorMean
+	}
+	return (click + scorer.PriorMean*scorer.PriorShows) / (show + scorer.PriorShows)
+}
+
+// the rate of a vid without ctr data, for wilson the same lower bound as a vid
+// with the prior pseudo-counts, so a vid with data is not ranked against the bare mean
+func (scorer *CtrScorer) priorRate() float64 {
+	if scorer.Method != CTR_METHOD_WILSON {
+		return scorer.PriorMean
+	}
+	if scorer.PriorShows == 0 {
+		return 0
+	}
+	return wilsonLowerBound(scorer.PriorMean*scorer.PriorShows, scorer.PriorShows, scorer.Z)
+}
+
+// lower bound of the Wilson score interval of click successes in show trials
+func wilsonLowerBound(click, show, z float64) float64 {
+	rate := click / show
+	z2 := z * z
+	center := rate + z2/(2*show)
+	margin := z * math.Sqrt(rate*(1-rate)/show+z2/(4*show*show))
+	return math.Max(0, (center-margin)/(1+z2/show))
+}
+
+func (scorer *CtrScorer) Score(input *ScoreInput) uint64 {
+	return uint64(math.Round(scorer.Rate(input.CtrInt) * CTR_SCORE_SCALE))
+}
+
+// the rate spread over the 256 weights
+func (scorer *CtrScorer) Weight(input *ScoreInput) uint8 {
+	return uint8(math.Round(scorer.Rate(input.CtrInt) * math.MaxUint8))
+}
+
+// TrendScorer orders by engagement decayed by age, a video loses half of its
+// score every HalfLife so fresh videos gaining traction beat old hits
+type TrendScorer struct {
+	HalfLife time.Duration
+	// engagement is the weighted sum of plays, comments and vote up clicks
+	PlayWeight    float64
+	CommentWeight float64
+	ClickWeight   float64
+}
+
+// DefaultTrendScorer is the trend list type before any build flag
+func DefaultTrendScorer() *TrendScorer {
+	return &TrendScorer{HalfLife: 48 * time.Hour, PlayWeight: 1, CommentWeight: 10, ClickWeight: 5}
+}
+
+func (scorer *TrendScorer) Name() string {
+	return LIST_TYPE_TREND
+}
+
+func (scorer *TrendScorer) KeySuffix() string {
+	return topicindex.TREND_SUFFIX
+}
+
+// the age of a video is measured against the build time
+func (scorer *TrendScorer) UsesBuildTime() bool {
+	return true
+}
+
+// Decay returns the share of the engagement left at the age of the video, in (0, 1]
+func (scorer *TrendScorer) Decay(input *ScoreInput) float64 {
+	return math.Exp2(-float64(input.Age()) / float64(scorer.HalfLife))
+}
+
+func (scorer *TrendScorer) Score(input *ScoreInput) uint64 {
+	engagement := scorer.PlayWeight*float64(input.Video.PlayCnt) +
+		scorer.CommentWeight*float64(input.Video.CommentCnt) +
+		scorer.ClickWeight*float64(input.VoteUp.GetClick())
+	score := engagement * scorer.Decay(input) * TREND_SCORE_SCALE
+	if !(score > 0) {
+		return 0
+	}
+	if score >= math.MaxUint64 {
+		return math.MaxUint64
+	}
+	return uint64(math.Round(score))
+}
+
+// the freshness spread over the 256 weights
+func (scorer *TrendScorer) Weight(input *ScoreInput) uint8 {
+	return uint8(math.Round(scorer.Decay(input) * math.MaxUint8))
+}
+
+// WeightQuantizer replaces the Weight every scorer gives with the bucket of one
+// feature, the buckets are stored in the index header so serving can decode them
+type WeightQuantizer struct {
+	Feature *scoreexpr.Expr
+	Buckets *topicindex.WeightBuckets
+}
+
+// NewWeightQuantizer parses feature, an expression over ScoreVariables, and splits
+// [min, max] into count buckets on a WEIGHT_SCALE_LINEAR or WEIGHT_SCALE_LOG scale
+func NewWeightQuantizer(feature string, scale string, min, max float64, count int) (*WeightQuantizer, error) {
+	expr, err := scoreexpr.Parse(feature, ScoreVariables())
+	if err != nil {
+		return nil, fmt.Errorf("weight feature, %v", err)
+	}
+	var buckets *topicindex.WeightBuckets
+	switch scale {
+	case WEIGHT_SCALE_LINEAR:
+		buckets, err = topicindex.LinearBuckets(feature, min, max, count)
+	case WEIGHT_SCALE_LOG:
+		buckets, err = topicindex.LogBuckets(feature, min, max, count)
+	default:
+		err = fmt.Errorf("unknown weight scale %q, expect %s or %s", scale, WEIGHT_SCALE_LINEAR, WEIGHT_SCALE_LOG)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &WeightQuantizer{Feature: expr, Buckets: buckets}, nil
+}
+
+// UsesBuildTime tells whether the weights of every list depend on the build time
+func (quantizer *WeightQuantizer) UsesBuildTime() bool {
+	return quantizer.Feature.Uses(BUILD_TIME_VARIABLE)
+}
+
+func (quantizer *WeightQuantizer) Weight(input *ScoreInput) uint8 {
+	return quantizer.Buckets.Weight(quantizer.Feature.Eval(scoreValues(input)))
+}
+
+var MicroVideoReshape map[uint64]MicroVideoItem = make(map[uint64]MicroVideoItem, 0)
+
+// scorer name -> topic id -> the list of the topic ordered by that scorer
+var TopicListReshape map[string]map[uint64]*TopicIndexItem = make(map[string]map[uint64]*TopicIndexItem, 0)
+var TopicReshape map[uint64]*TopicIndexItem = make(map[uint64]*TopicIndexItem, 0)
+var CtrVoteUpReshape map[string]*ctrstrpb.CtrInfo = make(map[string]*ctrstrpb.CtrInfo, 0)
+var CtrIntReshape map[uint64]*ctrintpb.CtrInfo = make(map[uint64]*ctrintpb.CtrInfo, 0)
+
+// one topic line of the topic data, parsed and waiting for its lists to be built
+type topicTask struct {
+	TopicId uint64
+	Item    TopicItem
+}
+
+// TopicListOptions tell how the lists of one topic are built
+type TopicListOptions struct {
+	// topics with fewer valid vids are skipped
+	MinimalVids int
+	// unix seconds handed to the scorers in ScoreInput
+	BuildTime int64
+	Scorers   []Scorer
+	// nil keeps the weights of the scorers
+	Quantizer *WeightQuantizer
+	// scorer name -> most DocItems kept in its lists, missing or 0 keeps every vid
+	MaxListLen map[string]int
+	// nil skips the author diversity pass
+	Diversity *DiversityOptions
+	// nil keeps near duplicate videos
+	Dedup *DedupOptions
+	// nil builds every topic, else called for each topic in file order before the
+	// lists are built, ok tells the topic is kept with lists instead of being built
+	Reuse func(TopicId uint64, Item *TopicItem) (lists map[string]*TopicIndexItem, ok bool)
+	// scorers whose lists are built even for a reused topic since they depend on
+	// BuildTime, see usesBuildTime
+	Rebuild []Scorer
+}
+
+// DedupOptions tell which vids of a list count as duplicates, only the best
+// scored vid of each group of duplicates stays in the list
+type DedupOptions struct {
+	// vids with the same non-zero MicroVideoItem.TitleSign are duplicates
+	TitleSign bool
+	// vids whose title simhash differ in at most this many bits are duplicates,
+	// negative skips the simhash
+	SimhashDistance int
+}
+
+// DiversityOptions limit how many vids of one author (MicroVideoItem.Mthid) any
+// Window consecutive positions of a list may hold
+type DiversityOptions struct {
+	Window       int
+	MaxPerAuthor int
+	// scorer names whose lists are re-ranked
+	ListTypes map[string]bool
+}
+
+// BuildStats count what the build did to the lists
+type BuildStats struct {
+	// topics written, with at least MinimalVids valid vids
+	Topics int
+	// topics whose lists were taken from the base dump instead of being built
+	ReusedTopics int
+	// list type -> vids placed below their rank by the author diversity pass
+	DiversityDemoted map[string]int
+	// list type -> vids dropped as duplicates of a better scored vid
+	DuplicatesDropped map[string]int
+}
+
+func addCounts(counts map[string]int, other map[string]int) map[string]int {
+	for name, count := range other {
+		if counts == nil {
+			counts = make(map[string]int, 0)
+		}
+		counts[name] += count
+	}
+	return counts
+}
+
+func (stats *BuildStats) add(other *BuildStats) {
+	stats.Topics += other.Topics
+	stats.ReusedTopics += other.ReusedTopics
+	stats.DiversityDemoted = addCounts(stats.DiversityDemoted, other.DiversityDemoted)
+	stats.DuplicatesDropped = addCounts(stats.DuplicatesDropped, other.DuplicatesDropped)
+}
+
+func printCounts(w io.Writer, format string, counts map[string]int) {
+	names := make([]string, 0, len(counts))
+	for name := range counts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, format, counts[name], name)
+	}
+}
+
+// Print writes the stats one line each, list types sorted by name
+func (stats *BuildStats) Print(w io.Writer) {
+	fmt.Fprintf(w, "built %d topics\n", stats.Topics)
+	if stats.ReusedTopics > 0 {
+		fmt.Fprintf(w, "reused %d topics of the base\n", stats.ReusedTopics)
+	}
+	printCounts(w, "dedup dropped %d vids in %s lists\n", stats.DuplicatesDropped)
+	printCounts(w, "diversity demoted %d vids in %s lists\n", stats.DiversityDemoted)
+}
+
+// lists of one topic and what building them did
+type topicResult struct {
+	Lists map[string]*TopicIndexItem
+	Stats BuildStats
+}
+
+// read Topic data from file and build the list of every scorer for every topic on
+// Workers goroutines
+func LoadTopicData(FileName string, Workers int, ListOpts *TopicListOptions,
+	MicroVideoReshape map[uint64]MicroVideoItem,
+	TopicListReshape map[string]map[uint64]*TopicIndexItem,
+	TopicReshape map[uint64]*TopicIndexItem,
+	CtrIntReshape map[uint64]*ctrintpb.CtrInfo,
+	CtrVoteUpReshape map[string]*ctrstrpb.CtrInfo) (*BuildStats, error) {
+	tasks, err := parseTopicData(FileName)
+	if err != nil {
+		return nil, err
+	}
+
+	// the workers only read the input maps and each writes its own result slot
+	results := make([]topicResult, len(tasks))
+	var buildIndexes []int
+	for index, task := range tasks {
+		if ListOpts.Reuse != nil {
+			if lists, ok := ListOpts.Reuse(task.TopicId, &task.Item); ok {
+				results[index].Lists = lists
+				results[index].Stats.ReusedTopics++
+				if len(ListOpts.Rebuild) == 0 {
+					continue
+				}
+			}
+		}
+		buildIndexes = append(buildIndexes, index)
+	}
+	// a reused topic only gets the lists of ListOpts.Rebuild built
+	rebuildOpts := *ListOpts
+	rebuildOpts.Scorers = ListOpts.Rebuild
+	if Workers < 1 {
+		Workers = 1
+	}
+	taskIndexes := make(chan int, Workers)
+	var wg sync.WaitGroup
+	for worker := 0; worker < Workers; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range taskIndexes {
+				if results[index].Lists == nil {
+					results[index].Lists = buildTopicLists(tasks[index], ListOpts, &results[index].Stats,
+						MicroVideoReshape, CtrIntReshape, CtrVoteUpReshape)
+					continue
+				}
+				var rebuildStats BuildStats
+				lists := buildTopicLists(tasks[index], &rebuildOpts, &rebuildStats,
+					MicroVideoReshape, CtrIntReshape, CtrVoteUpReshape)
+				if lists == nil {
+					// too few valid vids are left, a full build drops the topic as well
+					results[index].Lists = nil
+					continue
+				}
+				for name, itemIndexForScorer := range lists {
+					results[index].Lists[name] = itemIndexForScorer
+				}
+				// the topic still counts as reused
+				rebuildStats.Topics = 0
+				results[index].Stats.add(&rebuildStats)
+			}
+		}()
+	}
+	for _, index := range buildIndexes {
+		taskIndexes <- index
+	}
+	close(taskIndexes)
+	wg.Wait()
+
+	// merge in file order so the output does not depend on the scheduling
+	for _, scorer := range ListOpts.Scorers {
+		if _, ok := TopicListReshape[scorer.Name()]; !ok {
+			TopicListReshape[scorer.Name()] = make(map[uint64]*TopicIndexItem, 0)
+		}
+	}
+	stats := &BuildStats{}
+	var itemIndex TopicIndexItem
+	for index, task := range tasks {
+		if results[index].Lists == nil {
+			continue
+		}
+		stats.add(&results[index].Stats)
+		weight := uint8(0)
+		// an incremental build rebuilds the topics whose vid list changed, see reuseFromBase
+		sortVal := vidListHash(&task.Item)
+		itemIndex.DocList = append(itemIndex.DocList, &DocItem{
+			Vid: task.TopicId, Weight: weight, SortVal: sortVal})
+		for name, itemIndexForScorer := range results[index].Lists {
+			TopicListReshape[name][task.TopicId] = itemIndexForScorer
+		}
+	}
+	TopicReshape[TOPIC_ALL_8] = &itemIndex
+	return stats, nil
+}
+
+// read the topic lines, lines that cannot be parsed are reported and skipped
+func parseTopicData(FileName string) ([]*topicTask, error) {
+	fr, err := os.Open(FileName)
+	if err != nil {
+		err = fmt.Errorf("open topic data error: %v", err)
+		return nil, err
+	}
+	defer func() {
+		if err := fr.Close(); err != nil {
+			fmt.Printf("close filename %s failed\n", FileName)
+		}
+	}()
+	scanner := bufio.NewScanner(bufio.NewReader(fr))
+	scanner.Buffer(make([]byte, 0, bufio.MaxScanTokenSize), MAX_LINE_SIZE)
+
+	var tasks []*topicTask
+	for scanner.Scan() {
+		var itemEle TopicItem
+		if err := json.Unmarshal(scanner.Bytes(), &itemEle); err != nil {
+			err = fmt.Errorf("Unmarshal Topic data error: %v", err)
+			fmt.Fprintln(os.Stderr, err)
+			continue
+		}
+		topicId, err := strconv.ParseUint(itemEle.TopicId, 10, 64)
+		if err != nil {
+			err = fmt.Errorf("parse Topic topicid from string to uint64 error, topicid is %s, and err is %v", itemEle.TopicId, err)
+			fmt.Println(err)
+			continue
+		}
+		tasks = append(tasks, &topicTask{TopicId: topicId, Item: itemEle})
+	}
+	if err := scanner.Err(); err != nil {
+		err = fmt.Errorf("reading topic data %s error: %v", FileName, err)
+		return nil, err
+	}
+	return tasks, nil
+}
+
+// score and sort the list of every scorer for one topic, nil when it has fewer than MinimalVids valid vids
+func buildTopicLists(task *topicTask, ListOpts *TopicListOptions, Stats *BuildStats,
+	MicroVideoReshape map[uint64]MicroVideoItem,
+	CtrIntReshape map[uint64]*ctrintpb.CtrInfo,
+	CtrVoteUpReshape map[string]*ctrstrpb.CtrInfo) map[string]*TopicIndexItem {
+	lists := make(map[string]*TopicIndexItem, len(ListOpts.Scorers))
+	for _, scorer := range ListOpts.Scorers {
+		lists[scorer.Name()] = &TopicIndexItem{Title: task.Item.Title}
+	}
+	validVids := 0
+	var filterRepeatVid map[uint64]bool = make(map[uint64]bool, 0)
+	for _, itemStr := range task.Item.VidList {
+		item, err := strconv.ParseUint(itemStr, 10, 64)
+		if err != nil {
+			err = fmt.Errorf("parse Topic VidList.vid from string to uint64 error, vid is %s, and err is %v", itemStr, err)
+			fmt.Println(err)
+			continue
+		}
+		if _, ok := filterRepeatVid[item]; ok {
+			fmt.Printf("vid %d already exists\n", item)
+			continue
+		} else {
+			filterRepeatVid[item] = true
+		}
+
+		// search MicroVideoData map[uint64]MicroVideoItem
+		videoItem, ok := MicroVideoReshape[item]
+		if !ok {
+			fmt.Printf("the vid %v doesnot exist in json library\n", item)
+			continue
+		}
+		input := &ScoreInput{Vid: item, Video: &videoItem, BuildTime: ListOpts.BuildTime}
+		CtrVpVidKey := CTR_VP_PREFIX + itemStr
+		if CtrVpVal, ok := CtrVoteUpReshape[CtrVpVidKey]; ok {
+			input.VoteUp = CtrVpVal
+		} else {
+			fmt.Printf("the vid %v doesnot exist in ctr_string\n", item)
+		}
+		if CtrIntVal, ok := CtrIntReshape[item]; ok {
+			input.CtrInt = CtrIntVal
+		}
+		validVids++
+		// storage the vid, weight and score of every list
+		for _, scorer := range ListOpts.Scorers {
+			itemIndexForScorer := lists[scorer.Name()]
+			var weight uint8
+			if ListOpts.Quantizer != nil {
+				weight = ListOpts.Quantizer.Weight(input)
+			} else {
+				weight = scorer.Weight(input)
+			}
+			itemIndexForScorer.DocList = append(itemIndexForScorer.DocList,
+				&DocItem{Vid: item, Weight: weight, SortVal: scorer.Score(input)})
+		}
+	}
+	if validVids < ListOpts.MinimalVids {
+		return nil
+	}
+	Stats.Topics++
+	var titles map[uint64]titleKey
+	if ListOpts.Dedup != nil {
+		titles = make(map[uint64]titleKey, len(filterRepeatVid))
+		for vid := range filterRepeatVid {
+			if videoItem, ok := MicroVideoReshape[vid]; ok {
+				titles[vid] = newTitleKey(&videoItem, ListOpts.Dedup)
+			}
+		}
+	}
+	// according to SortVal to sort DocList slice, keeping at most the max length of the list type
+	for name, itemIndexForScorer := range lists {
+		maxLen := ListOpts.MaxListLen[name]
+		diversity := ListOpts.Diversity
+		if diversity != nil && !diversity.ListTypes[name] {
+			diversity = nil
+		}
+		if ListOpts.Dedup == nil && diversity == nil {
+			if maxLen > 0 && len(itemIndexForScorer.DocList) > maxLen {
+				itemIndexForScorer.Total = len(itemIndexForScorer.DocList)
+			}
+			itemIndexForScorer.DocList = selectTopK(itemIndexForScorer.DocList, maxLen)
+			continue
+		}
+
+		// both passes need the whole list in order, so a cut list is refilled from below the cut
+		docList := selectTopK(itemIndexForScorer.DocList, 0)
+		if ListOpts.Dedup != nil {
+			var dropped int
+			docList, dropped = dedupList(docList, ListOpts.Dedup, titles)
+			Stats.DuplicatesDropped = addCounts(Stats.DuplicatesDropped, map[string]int{name: dropped})
+		}
+		if diversity != nil {
+			var demoted int
+			docList, demoted = diversifyByAuthor(docList, diversity.Window, diversity.MaxPerAuthor, func(vid uint64) string {
+				return MicroVideoReshape[vid].Mthid
+			})
+			Stats.DiversityDemoted = addCounts(Stats.DiversityDemoted, map[string]int{name: demoted})
+		}
+		if maxLen > 0 && len(docList) > maxLen {
+			itemIndexForScorer.Total = len(docList)
+			docList = append([]*DocItem(nil), docList[:maxLen]...)
+		}
+		itemIndexForScorer.DocList = docList
+	}
+	return lists
+}
+
+// what dedupList compares of one video
+type titleKey struct {
+	TitleSign  uint64
+	Simhash    uint64
+	HasSimhash bool
+}
+
+func newTitleKey(videoItem *MicroVideoItem, opts *DedupOptions) titleKey {
+	key := titleKey{}
+	if opts.TitleSign {
+		key.TitleSign = videoItem.TitleSign
+	}
+	if opts.SimhashDistance >= 0 {
+		key.Simhash, key.HasSimhash = simhash.Sum(videoItem.Title)
+	}
+	return key
+}
+
+// drop the vids of the sorted DocList that duplicate a vid ranked above them
+func dedupList(DocList []*DocItem, opts *DedupOptions, titles map[uint64]titleKey) (kept []*DocItem, dropped int) {
+	seenSigns := make(map[uint64]bool, len(DocList))
+	var seenSums *simhash.Index
+	if opts.SimhashDistance >= 0 {
+		seenSums, _ = simhash.NewIndex(opts.SimhashDistance)
+	}
+	kept = make([]*DocItem, 0, len(DocList))
+	for _, DocItemEle := range DocList {
+		key := titles[DocItemEle.Vid]
+		if key.TitleSign != 0 && seenSigns[key.TitleSign] {
+			dropped++
+			continue
+		}
+		if key.HasSimhash && seenSums.Near(key.Simhash) {
+			dropped++
+			continue
+		}
+		if key.TitleSign != 0 {
+			seenSigns[key.TitleSign] = true
+		}
+		if key.HasSimhash {
+			seenSums.Add(key.Simhash)
+		}
+		kept = append(kept, DocItemEle)
+	}
+	return kept, dropped
+}
+
+// a DocItem with its position in the unsorted list, the earlier one wins a tie
+type rankedDoc struct {
+	Doc   *DocItem
+	Index int
+}
+
+func betterDoc(a, b rankedDoc) bool {
+	if a.Doc.SortVal != b.Doc.SortVal {
+		return a.Doc.SortVal > b.Doc.SortVal
+	}
+	return a.Index < b.Index
+}
+
+// min-heap of the K best DocItems seen so far, the worst of them on top
+type topKHeap []rankedDoc
+
+func (h topKHeap) Len() int {
+	return len(h)
+}
+
+func (h topKHeap) Less(i, j int) bool {
+	return betterDoc(h[j], h[i])
+}
+
+func (h topKHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+}
+
+func (h *topKHeap) Push(x interface{}) {
+	*h = append(*h, x.(rankedDoc))
+}
+
+func (h *topKHeap) Pop() interface{} {
+	old := *h
+	last := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return last
+}
+
+// the vids of one author not placed yet, in rank order
+type authorQueue struct {
+	Author string
+	Ranks  []int
+	// position in authorHeap, -1 when the author is not in it
+	HeapIndex int
+}
+
+// authors that may take the next position, the one with the best ranked vid on top
+type authorHeap []*authorQueue
+
+func (h authorHeap) Len() int {
+	return len(h)
+}
+
+func (h authorHeap) Less(i, j int) bool {
+	return h[i].Ranks[0] < h[j].Ranks[0]
+}
+
+func (h authorHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].HeapIndex = i
+	h[j].HeapIndex = j
+}
+
+func (h *authorHeap) Push(x interface{}) {
+	queue := x.(*authorQueue)
+	queue.HeapIndex = len(*h)
+	*h = append(*h, queue)
+}
+
+func (h *authorHeap) Pop() interface{} {
+	old := *h
+	last := old[len(old)-1]
+	last.HeapIndex = -1
+	*h = old[:len(old)-1]
+	return last
+}
+
+// re-rank the sorted DocList so no Window consecutive positions hold more than
+// MaxPerAuthor vids of one author, every position takes the best ranked vid whose
+// author is below the limit and the order is kept otherwise; when every author
+// left is at the limit the best ranked vid is placed anyway. Vids without author
+// are never limited. demoted counts the vids placed below their rank.
+func diversifyByAuthor(DocList []*DocItem, Window, MaxPerAuthor int, authorOf func(vid uint64) string) (reranked []*DocItem, demoted int) {
+	if Window <= MaxPerAuthor || len(DocList) <= MaxPerAuthor {
+		return DocList, 0
+	}
+	// authors with vids left to place
+	queues := make(map[string]*authorQueue, 0)
+	for rank, DocItemEle := range DocList {
+		author := authorOf(DocItemEle.Vid)
+		if author == "" {
+			author = "vid:" + strconv.FormatUint(DocItemEle.Vid, 10)
+		}
+		queue, ok := queues[author]
+		if !ok {
+			queue = &authorQueue{Author: author, HeapIndex: -1}
+			queues[author] = queue
+		}
+		queue.Ranks = append(queue.Ranks, rank)
+	}
+	eligible := make(authorHeap, 0, len(queues))
+	for _, queue := range queues {
+		heap.Push(&eligible, queue)
+	}
+
+	// authors of the last Window-1 positions and how many each has among them
+	inWindow := make(map[*authorQueue]int, Window)
+	recent := make([]*authorQueue, 0, len(DocList))
+	reranked = make([]*DocItem, 0, len(DocList))
+	for len(reranked) < len(DocList) {
+		var queue *authorQueue
+		if eligible.Len() > 0 {
+			queue = eligible[0]
+		} else {
+			// every author left is at the limit, they are all in the window, take the best ranked vid anyway
+			for _, candidate := range queues {
+				if queue == nil || candidate.Ranks[0] < queue.Ranks[0] {
+					queue = candidate
+				}
+			}
+		}
+		rank := queue.Ranks[0]
+		queue.Ranks = queue.Ranks[1:]
+		if len(queue.Ranks) == 0 {
+			delete(queues, queue.Author)
+		}
+		if rank < len(reranked) {
+			demoted++
+		}
+		reranked = append(reranked, DocList[rank])
+
+		recent = append(recent, queue)
+		inWindow[queue]++
+		if queue.HeapIndex >= 0 {
+			if len(queue.Ranks) == 0 || inWindow[queue] >= MaxPerAuthor {
+				heap.Remove(&eligible, queue.HeapIndex)
+			} else {
+				heap.Fix(&eligible, queue.HeapIndex)
+			}
+		}
+		// the oldest position leaves the window and may free its author
+		if len(recent) >= Window {
+			left := recent[len(recent)-Window]
+			inWindow[left]--
+			if left.HeapIndex < 0 && len(left.Ranks) > 0 && inWindow[left] < MaxPerAuthor {
+				heap.Push(&eligible, left)
+			}
+		}
+		if queue.HeapIndex < 0 && len(queue.Ranks) > 0 && inWindow[queue] < MaxPerAuthor {
+			heap.Push(&eligible, queue)
+		}
+	}
+	return reranked, demoted
+}
+
+// sort DocList by SortVal descending and keep the first K, K <= 0 keeps all of them;
+// equal SortVals keep their input order whether and however the list was cut
+func selectTopK(DocList []*DocItem, K int) []*DocItem {
+	if K <= 0 || len(DocList) <= K {
+		sort.Stable(ByScoreDescending(DocList))
+		return DocList
+	}
+	if len(DocList)/TOP_K_HEAP_RATIO < K {
+		sort.Stable(ByScoreDescending(DocList))
+		return append([]*DocItem(nil), DocList[:K]...)
+	}
+
+	best := make(topKHeap, 0, K)
+	for index, DocItemEle := range DocList {
+		candidate := rankedDoc{Doc: DocItemEle, Index: index}
+		if len(best) < K {
+			heap.Push(&best, candidate)
+		} else if betterDoc(candidate, best[0]) {
+			best[0] = candidate
+			heap.Fix(&best, 0)
+		}
+	}
+	sort.Slice(best, func(i, j int) bool {
+		return betterDoc(best[i], best[j])
+	})
+	topK := make([]*DocItem, 0, K)
+	for _, candidate := range best {
+		topK = append(topK, candidate.Doc)
+	}
+	return topK
+}
+
+// compute weight by shift bytes
+func (MicroVideoItem *MicroVideoItem) ComputeScoreForTime(CtrVpVal *ctrstrpb.CtrInfo) uint64 {
+	var weight uint64 = MicroVideoItem.PublishTime
+	return weight
+}
+
+// compute weight by shift bytes
+func (MicroVideoItem *MicroVideoItem) ComputeWeightForTime() uint8 {
+	publishTime := MicroVideoItem.PublishTime
+	var weight uint8 = 0
+	for index := 7; index >= 0; index-- {
+		shiftIndex, err := Int8ToUint8(int8(index))
+		if err != nil {
+			continue
+		}
+		shiftBits := shiftIndex * 8
+		if tmp_byte := (publishTime >> shiftBits) & 0xff; tmp_byte != 0 {
+			weight |= (0x01) << shiftIndex
+		}
+	}
+	return weight
+}
+
+// compute weight by shift bytes
+func (MicroVideoItem *MicroVideoItem) ComputeScoreForHot(CtrVpVal *ctrstrpb.CtrInfo) uint64 {
+	return uint64(CtrVpVal.GetClick())
+}
+
+// compute weight by shift bytes
+func (MicroVideoItem *MicroVideoItem) ComputeWeightForHot() uint8 {
+	mthid, err := strconv.ParseUint(MicroVideoItem.Mthid, 10, 64)
+	if err != nil {
+		err = fmt.Errorf("parse MicroVideoData.mthid from string to uint64 error, vid is %s, and err is %v", MicroVideoItem.Mthid, err)
+		fmt.Println(err)
+		mthid = 0
+	}
+
+	playCnt, commentCnt := MicroVideoItem.PlayCnt, MicroVideoItem.CommentCnt
+	var weight uint8 = 0
+	for index := 7; index >= 0; index-- {
+		shiftIndex, err := Int8ToUint8(int8(index))
+		if err != nil {
+			continue
+		}
+		shiftBits := shiftIndex * 8
+		if tmp_byte := ((mthid >> shiftBits) | (playCnt >> shiftBits) | (commentCnt >> shiftBits)) & 0xff; tmp_byte != 0 {
+			weight |= (0x01) << shiftIndex
+		}
+	}
+	return weight
+}
+
+// read MicroVideoDat from file whose format is json, it stops early when ctx is cancelled
+func LoadMicroVideoData(ctx context.Context, FileName string, MicroVideoReshape map[uint64]MicroVideoItem) error {
+	fr, err := os.Open(FileName)
+	if err != nil {
+		err = fmt.Errorf("open micro video data error: %v", err)
+		return err
+	}
+	defer func() {
+		if err := fr.Close(); err != nil {
+			fmt.Printf("close filename %s failed\n", FileName)
+		}
+	}()
+	scanner := bufio.NewScanner(bufio.NewReader(fr))
+	scanner.Buffer(make([]byte, 0, bufio.MaxScanTokenSize), MAX_LINE_SIZE)
+	for lineNo := 0; scanner.Scan(); lineNo++ {
+		if lineNo%CANCEL_CHECK_INTERVAL == 0 && ctx.Err() != nil {
+			return fmt.Errorf("load micro video data %s stopped: %w", FileName, ctx.Err())
+		}
+		var mvItem MicroVideoItem
+		if err := json.Unmarshal(scanner.Bytes(), &mvItem); err != nil {
+			err = fmt.Errorf("Unmarshal MicroVideo data error: %v", err)
+			fmt.Println(err)
+		} else {
+			vid, err := strconv.ParseUint(mvItem.Vid, 10, 64)
+			if err != nil {
+				err = fmt.Errorf("parse vid from string to uint64 error, vid is %s, and err is %v", mvItem.Vid, err)
+				fmt.Println(err)
+				continue
+
+			}
+			MicroVideoReshape[vid] = mvItem
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		err = fmt.Errorf("reading micro video data %s error: %v", FileName, err)
+		return err
+	}
+	return nil
+}
+
+func Float32ToBytes(order binary.ByteOrder, num float32) []byte {
+	bits := math.Float32bits(num)
+	bytes := make([]byte, 4)
+	order.PutUint32(bytes, bits)
+	return bytes
+}
+
+func Float64ToBytes(order binary.ByteOrder, num float64) []byte {
+	bits := math.Float64bits(num)
+	bytes := make([]byte, 8)
+	order.PutUint64(bytes, bits)
+	return bytes
+}
+
+func Uint8ToBytes(num uint8) []byte {
+	num_bytes := make([]byte, 1)
+	num_bytes[0] = byte(num)
+	return num_bytes
+}
+
+func Uint32ToBytes(order binary.ByteOrder, num uint32) []byte {
+	num_bytes := make([]byte, 4)
+	order.PutUint32(num_bytes, num)
+	return num_bytes
+}
+
+func Uint64ToBytes(order binary.ByteOrder, num uint64) []byte {
+	num_bytes := make([]byte, 8)
+	order.PutUint64(num_bytes, num)
+	return num_bytes
+}
+
+func BytesToFloat32(order binary.ByteOrder, bytes []byte) float32 {
+	bits := order.Uint32(bytes)
+	return math.Float32frombits(bits)
+}
+
+func BytesToFloat64(order binary.ByteOrder, bytes []byte) float64 {
+	bits := order.Uint64(bytes)
+	return math.Float64frombits(bits)
+}
+
+func BytesToUint32(order binary.ByteOrder, bytes []byte) uint32 {
+	return order.Uint32(bytes)
+}
+
+func BytesToUint64(order binary.ByteOrder, bytes []byte) uint64 {
+	return order.Uint64(bytes)
+}
+
+func Int8ToUint8(num int8) (uint8, error) {
+	var unum uint8 = 0
+	var err error = nil
+	var largeNum int64 = 0
+	if num < 0 {
+		largeNum -= int64(num)
+	} else {
+		largeNum = int64(num)
+	}
+
+	tmpStr := strconv.FormatInt(largeNum, 10)
+	if largeUnum, err := strconv.ParseUint(tmpStr, 10, 64); err == nil {
+		unum = uint8(largeUnum)
+	} else {
+		err = fmt.Errorf("Int8 to Uint8 failed, input is %d, error is %v", num, err)
+	}
+	return unum, err
+
+}
+func Int32ToUint32(num int32, base int) (uint32, error) {
+	var unum uint32 = 0
+	var err error = nil
+	if num >= 0 {
+		str := strconv.FormatInt(int64(num), base)
+		if unum64, err := strconv.ParseUint(str, base, 32); err == nil {
+			unum = uint32(unum64)
+		} else {
+			fmt.Println("str to uint32 error")
+		}
+	} else {
+		err = fmt.Errorf("input value is negative whose value is:%s", num)
+		fmt.Println("input value is smaller than zero")
+	}
+	return unum, err
+}
+
+func Int64ToUint64(num int64, base int) (uint64, error) {
+	var unum uint64 = 0
+	var err error = nil
+	if num >= 0 {
+		str := strconv.FormatInt(num, base)
+		if unum64, err := strconv.ParseUint(str, base, 64); err == nil {
+			unum = unum64
+		} else {
+			fmt.Println("str to uint64 error")
+		}
+	} else {
+		err = fmt.Errorf("input value is negative whose value is:%s", num)
+		fmt.Println("input value is smaller than zero")
+	}
+	return unum, err
+}
+
+func Uint64ToFloat64(num uint64, base int) (float64, error) {
+	var fnum float64 = 0
+	var err error = nil
+	num_str := strconv.FormatUint(num, base)
+	if fnum64, err := strconv.ParseFloat(num_str, base); err == nil {
+		fnum = fnum64
+	} else {
+		fmt.Println("str to float64 error")
+	}
+	return fnum, err
+}
+
+func Check(e error) {
+	if e != nil {
+		panic(e)
+	}
+}
+
+func WriteIndexDataToFile(writer *topicindex.Writer, key []byte, IndexItem *TopicIndexItem) error {
+	total := len(IndexItem.DocList)
+	if IndexItem.Total > total {
+		total = IndexItem.Total
+	}
+	if err := writer.WriteRecordWithTotal(key, IndexItem.DocList, total); err != nil {
+		err = fmt.Errorf("write index record error, key is %s, error is %v", key, err)
+		return err
+	}
+	fmt.Printf("key %s write %d doc items successfully\n", key, len(IndexItem.DocList))
+	return nil
+}
+
+func sortedTopicIds(TopicReshape map[uint64]*TopicIndexItem) []uint64 {
+	topicIds := make([]uint64, 0, len(TopicReshape))
+	for topicId := range TopicReshape {
+		topicIds = append(topicIds, topicId)
+	}
+	sort.Slice(topicIds, func(i, j int) bool { return topicIds[i] < topicIds[j] })
+	return topicIds
+}
+
+// one record of an index file
+type indexRecord struct {
+	Key  string
+	Item *TopicIndexItem
+}
+
+// records of TOPIC_ALL_8 and the list of every scorer for every topic, topics are
+// in id order so the same input always gives the same file
+func collectIndexRecords(Scorers []Scorer,
+	TopicListReshape map[string]map[uint64]*TopicIndexItem,
+	TopicReshape map[uint64]*TopicIndexItem) []indexRecord {
+	var records []indexRecord
+	for _, TopicId := range sortedTopicIds(TopicReshape) {
+		records = append(records, indexRecord{Key: topicindex.TOPIC_ALL_KEY, Item: TopicReshape[TopicId]})
+	}
+	for _, scorer := range Scorers {
+		scorerReshape := TopicListReshape[scorer.Name()]
+		for _, TopicId := range sortedTopicIds(scorerReshape) {
+			records = append(records, indexRecord{Key: topicindex.TopicKey(TopicId, scorer.KeySuffix()), Item: scorerReshape[TopicId]})
+		}
+	}
+	return records
+}
+
+// write Records to FileName, Layout holds the optional header Flags such as
+// FLAG_COMPRESSED_LISTS, the BlockSize and the Settings, Delta is nil for a full dump, returns the trailing checksum
+func writeIndexFile(FileName string, Layout topicindex.Header, Buckets *topicindex.WeightBuckets, Delta *topicindex.Delta, Records []indexRecord) (checksum uint32, err error) {
+	fw, err := os.Create(FileName)
+	if err != nil {
+		err = fmt.Errorf("create index file error: %v", err)
+		return 0, err
+	}
+	defer func() {
+		if closeErr := fw.Close(); closeErr != nil && err == nil {
+			err = fmt.Errorf("close Filename %s failed, error is %v", FileName, closeErr)
+		}
+	}()
+
+	// keep the SortVal of every DocItem so downstream can re-rank
+	flags := Layout.Flags | topicindex.FLAG_SORT_VAL
+	for _, record := range Records {
+		if record.Item.Total > len(record.Item.DocList) {
+			flags |= topicindex.FLAG_LIST_TOTAL
+		}
+	}
+	// the original length of cut lists is only recorded when some list was cut
+	writer, err := topicindex.NewWriter(fw, topicindex.Header{
+		Order:         topicindex.INDEX_BYTE_ORDER,
+		Flags:         flags,
+		RecordCount:   uint32(len(Records)),
+		WeightBuckets: Buckets,
+		Delta:         Delta,
+		BlockSize:     Layout.BlockSize,
+		Settings:      Layout.Settings,
+	})
+	if err != nil {
+		err = fmt.Errorf("index header write value error %v\n", err)
+		return 0, err
+	}
+	for _, record := range Records {
+		// first writing key to file, key_len first, and then key_value
+		if err = WriteIndexDataToFile(writer, []byte(record.Key), record.Item); err != nil {
+			return 0, err
+		}
+	}
+	// the trailing checksum marks the dump as complete
+	if err = writer.Close(); err != nil {
+		err = fmt.Errorf("finish index file %s error %v", FileName, err)
+		return 0, err
+	}
+	return writer.Checksum(), err
+}
+
+// write TOPIC_ALL_8 and the list of every scorer for every topic
+func DumpTopicIndex(FileName string, Layout topicindex.Header, Scorers []Scorer, Buckets *topicindex.WeightBuckets,
+	TopicListReshape map[string]map[uint64]*TopicIndexItem,
+	TopicReshape map[uint64]*TopicIndexItem) error {
+	_, err := writeIndexFile(FileName, Layout, Buckets, nil, collectIndexRecords(Scorers, TopicListReshape, TopicReshape))
+	return err
+}
+
+// name of the shard file of the dump FileName
+func ShardFileName(FileName string, Shard int) string {
+	return fmt.Sprintf("%s%s%d", FileName, SHARD_FILE_SUFFIX, Shard)
+}
+
+// write the records of DumpTopicIndex into ShardCount files by the topic id of the
+// key, TOPIC_ALL_8 goes into every shard, and list the shards in the manifest
+// FileName+MANIFEST_SUFFIX
+func DumpShardedTopicIndex(FileName string, ShardCount int, Layout topicindex.Header, Scorers []Scorer, Buckets *topicindex.WeightBuckets,
+	TopicListReshape map[string]map[uint64]*TopicIndexItem,
+	TopicReshape map[uint64]*TopicIndexItem) error {
+	shardRecords := make([][]indexRecord, ShardCount)
+	for _, record := range collectIndexRecords(Scorers, TopicListReshape, TopicReshape) {
+		TopicId, _, ok := topicindex.ParseTopicKey(record.Key)
+		if !ok {
+			for shard := range shardRecords {
+				shardRecords[shard] = append(shardRecords[shard], record)
+			}
+			continue
+		}
+		shard := topicindex.ShardOf(TopicId, ShardCount)
+		shardRecords[shard] = append(shardRecords[shard], record)
+	}
+
+	manifest := &topicindex.Manifest{ShardCount: ShardCount, Hash: topicindex.SHARD_HASH_FNV1A_64}
+	for shard, records := range shardRecords {
+		shardFileName := ShardFileName(FileName, shard)
+		checksum, err := writeIndexFile(shardFileName, Layout, Buckets, nil, records)
+		if err != nil {
+			return err
+		}
+		stat, err := os.Stat(shardFileName)
+		if err != nil {
+			return err
+		}
+		manifest.Shards = append(manifest.Shards, topicindex.ManifestShard{
+			File:     filepath.Base(shardFileName),
+			Checksum: checksum,
+			Records:  uint32(len(records)),
+			Size:     stat.Size(),
+		})
+		fmt.Printf("shard %d has %d records, crc %08x\n", shard, len(records), checksum)
+	}
+	// the manifest comes last so it never lists a shard that is not complete
+	if err := topicindex.WriteManifest(FileName+MANIFEST_SUFFIX, manifest); err != nil {
+		return fmt.Errorf("write manifest error: %v", err)
+	}
+	return nil
+}
+
+// write the delta of a build against Base: TopicListReshape holds only the rebuilt
+// topics, TopicIds every topic of the build, TopicReshape is empty when TOPIC_ALL_8
+// is not written. Keys of Base missing from the build are recorded as removed.
+func DumpTopicDelta(FileName string, Base *topicindex.Reader, Layout topicindex.Header, Scorers []Scorer, Buckets *topicindex.WeightBuckets,
+	TopicListReshape map[string]map[uint64]*TopicIndexItem,
+	TopicReshape map[uint64]*TopicIndexItem, TopicIds []uint64) error {
+	keys := make(map[string]bool, len(TopicIds)*len(Scorers)+1)
+	var records []indexRecord
+	for _, record := range collectIndexRecords(Scorers, TopicListReshape, TopicReshape) {
+		keys[record.Key] = true
+		if record.Key == topicindex.TOPIC_ALL_KEY {
+			// TOPIC_ALL_8 only goes into the delta when the topics or their vid lists changed
+			if same, err := sameAsBase(Base, record); err != nil {
+				return err
+			} else if same {
+				continue
+			}
+		}
+		records = append(records, record)
+	}
+	for _, TopicId := range TopicIds {
+		for _, scorer := range Scorers {
+			keys[topicindex.TopicKey(TopicId, scorer.KeySuffix())] = true
+		}
+	}
+	delta := &topicindex.Delta{BaseChecksum: Base.Checksum(), Removed: []string{}}
+	for _, key := range Base.Keys() {
+		if !keys[key] {
+			delta.Removed = append(delta.Removed, key)
+		}
+	}
+	sort.Strings(delta.Removed)
+	fmt.Printf("delta has %d changed keys and %d removed keys\n", len(records), len(delta.Removed))
+	_, err := writeIndexFile(FileName, Layout, Buckets, delta, records)
+	return err
+}
+
+// whether Base stores the same list under the key of Record
+func sameAsBase(Base *topicindex.Reader, Record indexRecord) (bool, error) {
+	DocItemList, err := Base.Get(Record.Key)
+	if errors.Is(err, topicindex.ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if len(DocItemList) != len(Record.Item.DocList) {
+		return false, nil
+	}
+	for index, DocItemEle := range DocItemList {
+		if *DocItemEle != *Record.Item.DocList[index] {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// the hash of the vid list a topic is built from, the SortVal of the topic in
+// TOPIC_ALL_8; the order counts since it breaks the ties of equal scores
+func vidListHash(Item *TopicItem) uint64 {
+	hasher := fnv.New64a()
+	for _, itemStr := range Item.VidList {
+		hasher.Write([]byte(itemStr))
+		hasher.Write([]byte{'\n'})
+	}
+	return hasher.Sum64()
+}
+
+// topics of Base listed in its TOPIC_ALL_8 with a list of every scorer -> the
+// vidListHash they were built from
+func baseTopicIds(Base *topicindex.Reader, Scorers []Scorer) (map[uint64]uint64, error) {
+	suffixes := make(map[string]bool, len(Scorers))
+	for _, scorer := range Scorers {
+		suffixes[scorer.KeySuffix()] = true
+	}
+	listed := make(map[uint64]int, 0)
+	for _, key := range Base.Keys() {
+		if TopicId, suffix, ok := topicindex.ParseTopicKey(key); ok && suffixes[suffix] {
+			listed[TopicId]++
+		}
+	}
+	allList, err := Base.Get(topicindex.TOPIC_ALL_KEY)
+	if errors.Is(err, topicindex.ErrNotFound) {
+		return nil, fmt.Errorf("base has no %s recording the vid lists of its topics, build it with the %s list",
+			topicindex.TOPIC_ALL_KEY, LIST_TYPE_ALL)
+	}
+	if err != nil {
+		return nil, err
+	}
+	topicIds := make(map[uint64]uint64, len(allList))
+	for _, DocItemEle := range allList {
+		if listed[DocItemEle.Vid] == len(suffixes) {
+			topicIds[DocItemEle.Vid] = DocItemEle.SortVal
+		}
+	}
+	return topicIds, nil
+}
+
+// read the lists of every scorer for TopicId from Base
+func loadBaseLists(Base *topicindex.Reader, Scorers []Scorer, TopicId uint64, Title string) (map[string]*TopicIndexItem, error) {
+	lists := make(map[string]*TopicIndexItem, len(Scorers))
+	for _, scorer := range Scorers {
+		key := topicindex.TopicKey(TopicId, scorer.KeySuffix())
+		DocItemList, err := Base.Get(key)
+		if err != nil {
+			return nil, err
+		}
+		total, err := Base.ListTotal(key)
+		if err != nil {
+			return nil, err
+		}
+		IndexItem := &TopicIndexItem{Title: Title, DocList: DocItemList}
+		if total > len(DocItemList) {
+			IndexItem.Total = total
+		}
+		lists[scorer.Name()] = IndexItem
+	}
+	return lists, nil
+}
+
+// read a file of uint64 ids, one per line, blank lines and lines starting with # are skipped
+func readIdSet(FileName string) (map[uint64]bool, error) {
+	fr, err := os.Open(FileName)
+	if err != nil {
+		return nil, err
+	}
+	defer fr.Close()
+	ids := make(map[uint64]bool, 0)
+	scanner := bufio.NewScanner(fr)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		id, err := strconv.ParseUint(line, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid id %q", FileName, lineNo, line)
+		}
+		ids[id] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// read the ctr file keyed by uint64 record by record, see package ctrkv for the layout,
+// it stops early when ctx is cancelled
+func LoadCtrIntData(ctx context.Context, FileName string, CtrIntReshape map[uint64]*ctrintpb.CtrInfo) error {
+	fr, err := os.Open(FileName)
+	if err != nil {
+		err = fmt.Errorf("open ctr data error: %v", err)
+		return err
+	}
+	defer func() {
+		if err := fr.Close(); err != nil {
+			fmt.Printf("close filename %s failed\n", FileName)
+		}
+	}()
+	reader := ctrkv.NewReader(fr)
+	for records := 0; reader.Next(); records++ {
+		if records%CANCEL_CHECK_INTERVAL == 0 && ctx.Err() != nil {
+			return fmt.Errorf("load ctr data %s stopped: %w", FileName, ctx.Err())
+		}
+		keyBytes := reader.Key()
+		if len(keyBytes) != int(UINT64_SIZE) {
+			fmt.Printf("key at offset %d has %d bytes, expect a uint64\n", reader.Offset(), len(keyBytes))
+			continue
+		}
+		key := BytesToUint64(ctrkv.BYTE_ORDER, keyBytes)
+		ctrPbPtr := &ctrintpb.CtrInfo{}
+		if err := proto.Unmarshal(reader.Value(), ctrPbPtr); err != nil {
+			fmt.Printf("Failed to parse CtrInfo string at offset %d: %v\n", reader.Offset(), err)
+		} else {
+			CtrIntReshape[key] = ctrPbPtr
+		}
+	}
+	if err := reader.Err(); err != nil {
+		err = fmt.Errorf("read ctr data %s error: %v", FileName, err)
+		return err
+	}
+	return nil
+}
+
+// read the vote up ctr file keyed by CTR_VP_PREFIX<vid> record by record,
+// it stops early when ctx is cancelled
+func LoadCtrVoteUpData(ctx context.Context, FileName string, CtrVoteUpReshape map[string]*ctrstrpb.CtrInfo) error {
+	fr, err := os.Open(FileName)
+	if err != nil {
+		err = fmt.Errorf("open ctr data error: %v", err)
+		return err
+	}
+	defer func() {
+		if err := fr.Close(); err != nil {
+			fmt.Printf("close filename %s failed\n", FileName)
+		}
+	}()
+	reader := ctrkv.NewReader(fr)
+	for records := 0; reader.Next(); records++ {
+		if records%CANCEL_CHECK_INTERVAL == 0 && ctx.Err() != nil {
+			return fmt.Errorf("load ctr data %s stopped: %w", FileName, ctx.Err())
+		}
+		key := string(reader.Key())
+		ctrPbPtr := &ctrstrpb.CtrInfo{}
+		if err := proto.Unmarshal(reader.Value(), ctrPbPtr); err != nil {
+			fmt.Printf("Failed to parse CtrInfo string at offset %d: %v\n", reader.Offset(), err)
+		} else if strings.Contains(key, CTR_VP_PREFIX) {
+			CtrVoteUpReshape[key] = ctrPbPtr
+		} else {
+			fmt.Printf("key: %s is not matched which should contain %s\n",
+				key, CTR_VP_PREFIX)
+		}
+	}
+	if err := reader.Err(); err != nil {
+		err = fmt.Errorf("read ctr data %s error: %v", FileName, err)
+		return err
+	}
+	return nil
+}
+
+// BuildOptions are the inputs and outputs of one index build
+type BuildOptions struct {
+	TopicFileName      string
+	MicroVideoFileName string
+	CtrIntFileName     string
+	CtrStrFileName     string
+	DumpTopicFileName  string
+	// LIST_TYPE_ALL and names of registered scorers to write
+	ListTypes   []string
+	MinimalVids int
+	// goroutines building the topic lists
+	Workers int
+	// list type -> most DocItems kept in each of its lists, missing or 0 keeps every vid
+	MaxListLen map[string]int
+	// tells the build time scores decay against, time.Now when nil
+	Clock func() time.Time
+	// nil keeps the weights of the scorers
+	WeightQuantizer *WeightQuantizer
+	// nil skips the author diversity pass
+	Diversity *DiversityOptions
+	// nil keeps near duplicate videos
+	Dedup *DedupOptions
+	// previous dump built with the same BuildSettings and the all list, its lists are
+	// reused for every topic with the same vid list, not in ChangedTopics and without
+	// a vid of ChangedVids, except the lists that depend on the build time; empty
+	// builds every topic
+	BaseFileName  string
+	ChangedVids   map[uint64]bool
+	ChangedTopics map[uint64]bool
+	// write only the keys that differ from the base, see topicindex.Delta
+	Delta bool
+	// split the dump into this many shard files by topic id, 0 writes one file
+	Shards int
+	// store the posting lists delta varint coded, see topicindex.FLAG_COMPRESSED_LISTS
+	CompressLists bool
+	// uncompressed bytes per flate block of the records, 0 leaves them uncompressed,
+	// see topicindex.FLAG_BLOCK_COMPRESSED
+	BlockSize uint32
+}
+
+// BuildSettings are what decides the lists of a topic besides the input data and
+// the build time, they are recorded in the header of a dump so an incremental
+// build refuses a base built otherwise. The weight buckets are recorded apart.
+type BuildSettings struct {
+	MinimalVids int `json:"min_vids"`
+	// scorer name -> what the scorer computes, see scorerSettings
+	Scorers    map[string]interface{} `json:"scorers"`
+	MaxListLen map[string]int         `json:"max_len,omitempty"`
+	Dedup      *DedupOptions          `json:"dedup,omitempty"`
+	Diversity  *DiversityOptions      `json:"diversity,omitempty"`
+}
+
+// what scorer computes, scorers defined in code are known by their key suffix
+func scorerSettings(scorer Scorer) interface{} {
+	switch scorer := scorer.(type) {
+	case *ExprScorer:
+		settings := map[string]interface{}{
+			"key_suffix": scorer.Suffix,
+			"score":      scorer.ScoreExpr.String(),
+			"scale":      scorer.Scale,
+		}
+		if scorer.WeightExpr != nil {
+			settings["weight"] = scorer.WeightExpr.String()
+		} else if scorer.WeightFrom != nil {
+			settings["weight_from"] = scorerSettings(scorer.WeightFrom)
+		}
+		return settings
+	case *CtrScorer, *TrendScorer:
+		return scorer
+	default:
+		return map[string]string{"key_suffix": scorer.KeySuffix()}
+	}
+}
+
+// Settings returns the BuildSettings of a build with Scorers as recorded in its dump
+func (opts *BuildOptions) Settings(Scorers []Scorer) (string, error) {
+	settings := BuildSettings{
+		MinimalVids: opts.MinimalVids,
+		Scorers:     make(map[string]interface{}, len(Scorers)),
+		MaxListLen:  opts.MaxListLen,
+		Dedup:       opts.Dedup,
+		Diversity:   opts.Diversity,
+	}
+	for _, scorer := range Scorers {
+		settings.Scorers[scorer.Name()] = scorerSettings(scorer)
+	}
+	buf, err := json.Marshal(settings)
+	if err != nil {
+		return "", fmt.Errorf("encode build settings error: %v", err)
+	}
+	return string(buf), nil
+}
+
+func (opts *BuildOptions) hasListType(listType string) bool {
+	for _, name := range opts.ListTypes {
+		if name == listType {
+			return true
+		}
+	}
+	return false
+}
+
+// LoadErrors are the failures of loaders that ran together
+type LoadErrors []error
+
+func (errs LoadErrors) Error() string {
+	messages := make([]string, 0, len(errs))
+	for _, err := range errs {
+		messages = append(messages, err.Error())
+	}
+	return strings.Join(messages, "; ")
+}
+
+// load the micro video data and both ctr files in parallel, they do not depend on
+// each other, the first failure cancels the other loaders
+func LoadBuildInputs(opts BuildOptions) error {
+	return runLoaders([]func(context.Context) error{
+		func(ctx context.Context) error {
+			return LoadMicroVideoData(ctx, opts.MicroVideoFileName, MicroVideoReshape)
+		},
+		func(ctx context.Context) error {
+			return LoadCtrIntData(ctx, opts.CtrIntFileName, CtrIntReshape)
+		},
+		func(ctx context.Context) error {
+			return LoadCtrVoteUpData(ctx, opts.CtrStrFileName, CtrVoteUpReshape)
+		},
+	})
+}
+
+// run Loaders in parallel, the first failure cancels the others, returns the
+// LoadErrors of every loader that failed on its own
+func runLoaders(Loaders []func(context.Context) error) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	loadErrs := make([]error, len(Loaders))
+	var wg sync.WaitGroup
+	for index, loader := range Loaders {
+		wg.Add(1)
+		go func(index int, loader func(context.Context) error) {
+			defer wg.Done()
+			if err := loader(ctx); err != nil {
+				loadErrs[index] = err
+				cancel()
+			}
+		}(index, loader)
+	}
+	wg.Wait()
+
+	// loaders stopped by the cancellation only echo the real failures
+	var errs LoadErrors
+	for _, err := range loadErrs {
+		if err != nil && !errors.Is(err, context.Canceled) {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func ExecuteProcess(opts BuildOptions) (*BuildStats, error) {
+	var scorers []Scorer
+	for _, name := range opts.ListTypes {
+		if name == LIST_TYPE_ALL {
+			continue
+		}
+		scorer, ok := LookupScorer(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown list type %s", name)
+		}
+		scorers = append(scorers, scorer)
+	}
+
+	// LoadTopicData needs every other input loaded first
+	if err := LoadBuildInputs(opts); err != nil {
+		return nil, err
+	}
+	clock := opts.Clock
+	if clock == nil {
+		clock = time.Now
+	}
+	var buckets *topicindex.WeightBuckets
+	if opts.WeightQuantizer != nil {
+		buckets = opts.WeightQuantizer.Buckets
+	}
+	ListOpts := &TopicListOptions{
+		MinimalVids: opts.MinimalVids,
+		BuildTime:   clock().Unix(),
+		Scorers:     scorers,
+		Quantizer:   opts.WeightQuantizer,
+		MaxListLen:  opts.MaxListLen,
+		Diversity:   opts.Diversity,
+		Dedup:       opts.Dedup,
+	}
+	settings, err := opts.Settings(scorers)
+	if err != nil {
+		return nil, err
+	}
+	var base *topicindex.Reader
+	if opts.BaseFileName != "" {
+		if base, err = openBase(opts.BaseFileName, buckets, settings, opts.Delta); err != nil {
+			return nil, err
+		}
+		defer base.Close()
+		// weights of a feature over the build time make every list depend on it
+		timedWeights := opts.WeightQuantizer != nil && opts.WeightQuantizer.UsesBuildTime()
+		for _, scorer := range scorers {
+			if timedWeights || usesBuildTime(scorer) {
+				ListOpts.Rebuild = append(ListOpts.Rebuild, scorer)
+			}
+		}
+		if ListOpts.Reuse, err = reuseFromBase(base, scorers, ListOpts.Rebuild, opts); err != nil {
+			return nil, err
+		}
+	}
+	stats, err := LoadTopicData(opts.TopicFileName, opts.Workers, ListOpts, MicroVideoReshape,
+		TopicListReshape, TopicReshape, CtrIntReshape, CtrVoteUpReshape)
+	if err != nil {
+		return nil, err
+	}
+
+	// TOPIC_ALL_8 is always built since it decides which topics are kept
+	allReshape := TopicReshape
+	if !opts.hasListType(LIST_TYPE_ALL) {
+		allReshape = map[uint64]*TopicIndexItem{}
+	}
+	layout := topicindex.Header{BlockSize: opts.BlockSize, Settings: settings}
+	if opts.CompressLists {
+		layout.Flags |= topicindex.FLAG_COMPRESSED_LISTS
+	}
+	if opts.Delta {
+		var topicIds []uint64
+		for _, DocItemEle := range TopicReshape[TOPIC_ALL_8].DocList {
+			topicIds = append(topicIds, DocItemEle.Vid)
+		}
+		err = DumpTopicDelta(opts.DumpTopicFileName, base, layout, scorers, buckets, TopicListReshape, allReshape, topicIds)
+	} else if opts.Shards > 0 {
+		err = DumpShardedTopicIndex(opts.DumpTopicFileName, opts.Shards, layout, scorers, buckets, TopicListReshape, allReshape)
+	} else {
+		err = DumpTopicIndex(opts.DumpTopicFileName, layout, scorers, buckets, TopicListReshape, allReshape)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// open the base dump of an incremental build, its lists must be built like the
+// lists of this build and a delta needs a full v2 base to point at
+func openBase(FileName string, Buckets *topicindex.WeightBuckets, Settings string, Delta bool) (*topicindex.Reader, error) {
+	base, err := topicindex.Open(FileName)
+	if err != nil {
+		return nil, fmt.Errorf("open base index error: %v", err)
+	}
+	header := base.Header()
+	switch {
+	case header.Delta != nil:
+		err = fmt.Errorf("base index %s is a delta, build against a full dump", FileName)
+	case !header.HasSortVal():
+		err = fmt.Errorf("base index %s has no SortVal to reuse", FileName)
+	case !reflect.DeepEqual(header.WeightBuckets, Buckets):
+		err = fmt.Errorf("base index %s was built with other weight buckets", FileName)
+	case header.Settings == "":
+		err = fmt.Errorf("base index %s records no build settings, rebuild it in full", FileName)
+	case header.Settings != Settings:
+		err = fmt.Errorf("base index %s was built with other settings, rebuild it in full\n\tbase:  %s\n\tbuild: %s",
+			FileName, header.Settings, Settings)
+	case Delta && header.Version < topicindex.FORMAT_V2:
+		err = fmt.Errorf("base index %s is version %d, a delta needs version %d", FileName, header.Version, topicindex.FORMAT_V2)
+	}
+	if err != nil {
+		base.Close()
+		return nil, err
+	}
+	return base, nil
+}
+
+// the TopicListOptions.Reuse of an incremental build, a topic is reused when the
+// base built it from the same vid list. A delta only holds the rebuilt topics so
+// the lists of reused topics are not read from the base, nor are the lists of
+// Rebuild which are built anyway
+func reuseFromBase(Base *topicindex.Reader, Scorers []Scorer, Rebuild []Scorer, opts BuildOptions) (func(uint64, *TopicItem) (map[string]*TopicIndexItem, bool), error) {
+	baseTopics, err := baseTopicIds(Base, Scorers)
+	if err != nil {
+		return nil, fmt.Errorf("read base index error: %v", err)
+	}
+	rebuilt := make(map[string]bool, len(Rebuild))
+	for _, scorer := range Rebuild {
+		rebuilt[scorer.Name()] = true
+	}
+	var reused []Scorer
+	for _, scorer := range Scorers {
+		if !rebuilt[scorer.Name()] {
+			reused = append(reused, scorer)
+		}
+	}
+	return func(TopicId uint64, Item *TopicItem) (map[string]*TopicIndexItem, bool) {
+		if baseHash, ok := baseTopics[TopicId]; !ok || baseHash != vidListHash(Item) || opts.ChangedTopics[TopicId] {
+			return nil, false
+		}
+		for _, itemStr := range Item.VidList {
+			if vid, err := strconv.ParseUint(itemStr, 10, 64); err == nil && opts.ChangedVids[vid] {
+				return nil, false
+			}
+		}
+		if opts.Delta {
+			return map[string]*TopicIndexItem{}, true
+		}
+		lists, err := loadBaseLists(Base, reused, TopicId, Item.Title)
+		if err != nil {
+			// the base was verified on open, rebuilding is still correct
+			fmt.Fprintf(os.Stderr, "read base lists of topic %d error: %v\n", TopicId, err)
+			return nil, false
+		}
+		return lists, true
+	}, nil
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %s <command> [flags]\n\n", os.Args[0])
+	fmt.Fprintln(os.Stderr, "commands:")
+	fmt.Fprintln(os.Stderr, "  build    build dump_topic_index from the topic, video and ctr data")
+	fmt.Fprintln(os.Stderr, "  inspect  print the header, keys and posting lists of an index file")
+	fmt.Fprintln(os.Stderr, "  diff     compare two index files key by key")
+	fmt.Fprintln(os.Stderr, "  merge    combine index files into one with a fresh key directory")
+	fmt.Fprintln(os.Stderr, "  ctr      convert ctr key/value files to json lines and back")
+	fmt.Fprintf(os.Stderr, "\nrun '%s <command> -h' for the flags of a command\n", os.Args[0])
+}
+
+// parse the -max-len of build, a bare length applies to every scorer in names
+func parseMaxListLen(value string, names []string) (map[string]int, error) {
+	maxListLen := make(map[string]int, len(names))
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		name, lengthStr := "", part
+		if index := strings.IndexByte(part, '='); index >= 0 {
+			name, lengthStr = strings.TrimSpace(part[:index]), strings.TrimSpace(part[index+1:])
+		}
+		length, err := strconv.Atoi(lengthStr)
+		if err != nil || length < 0 {
+			return nil, fmt.Errorf("invalid length %q, expect a number not below 0", lengthStr)
+		}
+		if name == "" {
+			for _, scorerName := range names {
+				maxListLen[scorerName] = length
+			}
+			continue
+		}
+		if _, ok := LookupScorer(name); !ok {
+			return nil, fmt.Errorf("unknown list type %s, expect any of %s", name, strings.Join(names, ","))
+		}
+		maxListLen[name] = length
+	}
+	return maxListLen, nil
 }
 
-func DumpTopicIndex(FileName string,
-	TopicHotReshape map[uint64]*TopicIndexItem,
-	TopicTimeReshape map[uint64]*TopicIndexItem,
-	TopicReshape map[uint64]*TopicIndexItem) error {
-	var err error = nil
-	fw, err := os.Create(FileName)
-	Check(err)
-	defer func() {
-		if err = fw.Close(); err != nil {
-			err = fmt.Errorf("close Filename %s failed, error is %v", FileName, err)
+func runBuild(args []string) int {
+	flags := flag.NewFlagSet("build", flag.ContinueOnError)
+	topicFileName := flags.String("topic", "./data/topic_data", "topic data, one json TopicItem per line")
+	microVideoFileName := flags.String("video", "./data/content_model_cache.data", "micro video data, one json MicroVideoItem per line")
+	ctrIntFileName := flags.String("ctr-int", "./data/ctr_url_kv", "ctr data keyed by uint64")
+	ctrStrFileName := flags.String("ctr-str", "./data/vu_vd", "vote up ctr data keyed by "+CTR_VP_PREFIX+"<vid>")
+	dumpTopicFileName := flags.String("output", "./data/dump_topic_index", "index file to write")
+	listTypes := flags.String("lists", strings.Join(LIST_TYPES, ","), "comma separated list types to write, any of "+strings.Join(listTypeNames(), ",")+" and the scorers of -config")
+	defaultCtr := DefaultCtrScorer()
+	ctrMethod := flags.String("ctr-method", defaultCtr.Method, "smoothing of the ctr list, "+CTR_METHOD_BAYES+" or "+CTR_METHOD_WILSON)
+	ctrPriorMean := flags.Float64("ctr-prior-mean", defaultCtr.PriorMean, "click-through rate assumed without data, the rate of vids without ctr for bayes")
+	ctrPriorShows := flags.Float64("ctr-prior-shows", defaultCtr.PriorShows, "how many shows the prior mean is worth, wilson scores vids without ctr by these pseudo-counts")
+	ctrZ := flags.Float64("ctr-z", defaultCtr.Z, "wilson: z-score of the lower bound, 1.96 for 95% confidence")
+	trendHalfLife := flags.Duration("trend-half-life", DefaultTrendScorer().HalfLife, "trend: age at which a video keeps half of its engagement")
+	now := flags.Int64("now", 0, "unix seconds to build as of, the current time when 0")
+	weightFeature := flags.String("weight-feature", "", "expression over the score variables whose bucket becomes the weight of every list, e.g. PlayCnt or Age/3600; empty keeps the weights of the scorers")
+	weightScale := flags.String("weight-scale", WEIGHT_SCALE_LOG, "spacing of the weight buckets, "+WEIGHT_SCALE_LINEAR+" or "+WEIGHT_SCALE_LOG)
+	weightMin := flags.Float64("weight-min", 1, "feature value where bucket 1 starts, lower values get weight 0")
+	weightMax := flags.Float64("weight-max", 1e8, "feature value where the last bucket starts")
+	weightBuckets := flags.Int("weight-buckets", topicindex.MAX_WEIGHT_BOUNDS+1, "number of weight buckets")
+	maxListLen := flags.String("max-len", "", "most vids kept per list, e.g. 500 for every list type or hot=500,new=1000; empty keeps every vid")
+	diversityWindow := flags.Int("diversity-window", 0, "re-rank so any this many consecutive positions hold at most -diversity-max-per-author vids of one author, 0 skips it")
+	diversityMaxPerAuthor := flags.Int("diversity-max-per-author", 1, "vids of one author allowed in a diversity window")
+	diversityLists := flags.String("diversity-lists", LIST_TYPE_HOT, "comma separated list types the diversity pass re-ranks")
+	dedupTitleSign := flags.Bool("dedup-title-sign", false, "keep only the best scored vid of each title_sign in a list")
+	dedupSimhash := flags.Int("dedup-simhash-distance", -1, "keep only the best scored vid of titles whose simhash differ in at most this many bits, negative skips it")
+	configFileName := flags.String("config", "", "json score config defining or replacing scorers, see ScoreConfig")
+	minimalVids := flags.Int("min-vids", MINIMAL_VIDS, "skip topics with fewer valid vids")
+	workers := flags.Int("workers", runtime.NumCPU(), "goroutines building the topic lists")
+	baseFileName := flags.String("base", "", "previous dump built with the same list settings and the all list, only topics with a changed vid list or changed inputs are rebuilt and the others keep its lists, except the lists that depend on -now")
+	changedVids := flags.String("changed-vids", "", "file of vids, one per line, whose video or ctr data changed since -base; their topics are rebuilt")
+	changedTopics := flags.String("changed-topics", "", "file of topic ids, one per line, rebuilt whatever their vids")
+	delta := flags.Bool("delta", false, "write only the keys that differ from -base, read it with inspect -delta")
+	compressLists := flags.Bool("compress-lists", false, "store the posting lists as sorted vid gaps in varints with their rank order, readers decode them transparently")
+	blockSize := flags.Int("block-size", 0, "compress the records in flate blocks of about this many bytes that are decompressed one at a time on lookup, 0 leaves them uncompressed")
+	shards := flags.Int("shards", 0, "split the output by topic id into this many files <output>"+SHARD_FILE_SUFFIX+"<i> listed in <output>"+MANIFEST_SUFFIX+", 0 writes one file")
+	if err := flags.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return EXIT_OK
 		}
-	}()
-	buf_fw := bufio.NewWriter(fw)
+		return EXIT_USAGE
+	}
+	if flags.NArg() != 0 {
+		fmt.Fprintf(os.Stderr, "build: unexpected arguments %v\n", flags.Args())
+		return EXIT_USAGE
+	}
 
-	if len_w, err := buf_fw.Write(Uint32ToBytes(DOC_ITEM_SIZE)); err != nil {
-		err = fmt.Errorf("DOC_ITEM_SIZE write value error %v\n", err)
-		return err
+	opts := BuildOptions{
+		TopicFileName:      *topicFileName,
+		MicroVideoFileName: *microVideoFileName,
+		CtrIntFileName:     *ctrIntFileName,
+		CtrStrFileName:     *ctrStrFileName,
+		DumpTopicFileName:  *dumpTopicFileName,
+		MinimalVids:        *minimalVids,
+		Workers:            *workers,
+	}
+	if *weightFeature != "" {
+		quantizer, err := NewWeightQuantizer(*weightFeature, *weightScale, *weightMin, *weightMax, *weightBuckets)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "build: %v\n", err)
+			return EXIT_USAGE
+		}
+		opts.WeightQuantizer = quantizer
+	}
+	if *now < 0 {
+		fmt.Fprintf(os.Stderr, "build: -now must not be negative, got %d\n", *now)
+		return EXIT_USAGE
+	}
+	if *now != 0 {
+		buildTime := time.Unix(*now, 0)
+		opts.Clock = func() time.Time {
+			return buildTime
+		}
+	}
+	ctrScorer := &CtrScorer{Method: *ctrMethod, PriorMean: *ctrPriorMean, PriorShows: *ctrPriorShows, Z: *ctrZ}
+	if err := ctrScorer.Validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "build: %v\n", err)
+		return EXIT_USAGE
+	}
+	Check(ReplaceScorer(ctrScorer))
+	if *trendHalfLife <= 0 {
+		fmt.Fprintf(os.Stderr, "build: -trend-half-life must be positive, got %v\n", *trendHalfLife)
+		return EXIT_USAGE
+	}
+	trendScorer := DefaultTrendScorer()
+	trendScorer.HalfLife = *trendHalfLife
+	Check(ReplaceScorer(trendScorer))
+	// the config comes last so it can still redefine the ctr list
+	if *configFileName != "" {
+		if err := LoadScoreConfig(*configFileName); err != nil {
+			fmt.Fprintf(os.Stderr, "build: %v\n", err)
+			return EXIT_USAGE
+		}
+	}
+	for _, listType := range strings.Split(*listTypes, ",") {
+		listType = strings.TrimSpace(listType)
+		if listType == "" {
+			continue
+		}
+		known := false
+		for _, name := range listTypeNames() {
+			known = known || name == listType
+		}
+		if !known {
+			fmt.Fprintf(os.Stderr, "build: unknown list type %s, expect any of %s\n", listType, strings.Join(listTypeNames(), ","))
+			return EXIT_USAGE
+		}
+		opts.ListTypes = append(opts.ListTypes, listType)
+	}
+	if *maxListLen != "" {
+		var err error
+		if opts.MaxListLen, err = parseMaxListLen(*maxListLen, ScorerNames()); err != nil {
+			fmt.Fprintf(os.Stderr, "build: -max-len: %v\n", err)
+			return EXIT_USAGE
+		}
+	}
+	if *dedupTitleSign || *dedupSimhash >= 0 {
+		if *dedupSimhash > simhash.MAX_DISTANCE {
+			fmt.Fprintf(os.Stderr, "build: -dedup-simhash-distance must be at most %d, got %d\n", simhash.MAX_DISTANCE, *dedupSimhash)
+			return EXIT_USAGE
+		}
+		opts.Dedup = &DedupOptions{TitleSign: *dedupTitleSign, SimhashDistance: *dedupSimhash}
+	}
+	if *diversityWindow != 0 {
+		if *diversityWindow < 2 || *diversityMaxPerAuthor < 1 {
+			fmt.Fprintf(os.Stderr, "build: -diversity-window must be at least 2 and -diversity-max-per-author at least 1, got %d and %d\n",
+				*diversityWindow, *diversityMaxPerAuthor)
+			return EXIT_USAGE
+		}
+		opts.Diversity = &DiversityOptions{
+			Window:       *diversityWindow,
+			MaxPerAuthor: *diversityMaxPerAuthor,
+			ListTypes:    make(map[string]bool, 0),
+		}
+		for _, listType := range strings.Split(*diversityLists, ",") {
+			listType = strings.TrimSpace(listType)
+			if listType == "" {
+				continue
+			}
+			if _, ok := LookupScorer(listType); !ok {
+				fmt.Fprintf(os.Stderr, "build: -diversity-lists: unknown list type %s, expect any of %s\n", listType, strings.Join(ScorerNames(), ","))
+				return EXIT_USAGE
+			}
+			opts.Diversity.ListTypes[listType] = true
+		}
+	}
+	if len(opts.ListTypes) == 0 {
+		fmt.Fprintln(os.Stderr, "build: no list type to write")
+		return EXIT_USAGE
+	}
+	if opts.Workers < 1 {
+		fmt.Fprintf(os.Stderr, "build: -workers must be at least 1, got %d\n", opts.Workers)
+		return EXIT_USAGE
+	}
+	if opts.MinimalVids < 0 {
+		fmt.Fprintf(os.Stderr, "build: -min-vids must not be negative, got %d\n", opts.MinimalVids)
+		return EXIT_USAGE
+	}
+
+	if *baseFileName == "" && (*changedVids != "" || *changedTopics != "" || *delta) {
+		fmt.Fprintln(os.Stderr, "build: -changed-vids, -changed-topics and -delta need -base")
+		return EXIT_USAGE
+	}
+	opts.BaseFileName = *baseFileName
+	opts.Delta = *delta
+	if *shards < 0 || *shards > topicindex.MAX_SHARDS {
+		fmt.Fprintf(os.Stderr, "build: -shards must be in [0, %d], got %d\n", topicindex.MAX_SHARDS, *shards)
+		return EXIT_USAGE
+	}
+	if *shards > 0 && *delta {
+		fmt.Fprintln(os.Stderr, "build: -shards cannot be combined with -delta")
+		return EXIT_USAGE
+	}
+	opts.Shards = *shards
+	opts.CompressLists = *compressLists
+	if *blockSize < 0 || *blockSize > topicindex.MAX_BLOCK_SIZE {
+		fmt.Fprintf(os.Stderr, "build: -block-size must be in [0, %d], got %d\n", topicindex.MAX_BLOCK_SIZE, *blockSize)
+		return EXIT_USAGE
+	}
+	opts.BlockSize = uint32(*blockSize)
+	if *changedVids != "" {
+		var err error
+		if opts.ChangedVids, err = readIdSet(*changedVids); err != nil {
+			fmt.Fprintf(os.Stderr, "build: -changed-vids: %v\n", err)
+			return EXIT_USAGE
+		}
+	}
+	if *changedTopics != "" {
+		var err error
+		if opts.ChangedTopics, err = readIdSet(*changedTopics); err != nil {
+			fmt.Fprintf(os.Stderr, "build: -changed-topics: %v\n", err)
+			return EXIT_USAGE
+		}
+	}
+
+	stats, err := ExecuteProcess(opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "build failed: %v\n", err)
+		return EXIT_FAILURE
+	}
+	stats.Print(os.Stdout)
+	return EXIT_OK
+}
+
+// rows printed by the inspect command in json format, one json object per line
+type inspectHeaderRow struct {
+	Type         string `json:"type"`
+	Version      uint16 `json:"version"`
+	ByteOrder    string `json:"byte_order"`
+	Flags        uint32 `json:"flags"`
+	ItemSize     uint32 `json:"item_size"`
+	RecordCount  uint32 `json:"record_count"`
+	KeyDirectory bool   `json:"key_directory"`
+	SortVal      bool   `json:"sort_val"`
+	// posting lists are stored delta varint coded
+	CompressedLists bool `json:"compressed_lists,omitempty"`
+	// records are stored in flate blocks of this many uncompressed bytes
+	BlockSize uint32 `json:"block_size,omitempty"`
+	// the BuildSettings json the dump was built with
+	Settings string `json:"settings,omitempty"`
+	// set when the weights are buckets of a feature
+	WeightFeature string    `json:"weight_feature,omitempty"`
+	WeightBounds  []float64 `json:"weight_bounds,omitempty"`
+	// set for a delta file
+	BaseChecksum *uint32  `json:"base_checksum,omitempty"`
+	Removed      []string `json:"removed,omitempty"`
+}
+
+type inspectKeyRow struct {
+	Type  string `json:"type"`
+	Key   string `json:"key"`
+	Count int    `json:"count"`
+	// length before the list was cut, only for cut lists
+	Total int `json:"total,omitempty"`
+}
+
+type inspectItemRow struct {
+	Type   string  `json:"type"`
+	Key    string  `json:"key"`
+	Rank   int     `json:"rank"`
+	Vid    uint64  `json:"vid"`
+	Weight uint8   `json:"weight"`
+	Score  *uint64 `json:"score,omitempty"`
+}
+
+func runInspect(args []string) int {
+	flags := flag.NewFlagSet("inspect", flag.ContinueOnError)
+	indexFileName := flags.String("index", "./data/dump_topic_index", "index file to inspect")
+	key := flags.String("key", "", "also print the DocItems of this key, e.g. "+topicindex.TOPIC_ALL_KEY)
+	format := flags.String("format", "text", "output format, text or json (one object per line)")
+	skipVerify := flags.Bool("skip-verify", false, "do not check the index checksum")
+	deltaFileName := flags.String("delta", "", "delta file built with build -delta against -index, inspect -index with it applied")
+	manifestFileName := flags.String("manifest", "", "manifest of a sharded dump, inspect its shard -shard instead of -index")
+	shard := flags.Int("shard", 0, "shard of -manifest to inspect")
+	if err := flags.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return EXIT_OK
+		}
+		return EXIT_USAGE
+	}
+	if flags.NArg() != 0 {
+		fmt.Fprintf(os.Stderr, "inspect: unexpected arguments %v\n", flags.Args())
+		return EXIT_USAGE
+	}
+	if *format != "text" && *format != "json" {
+		fmt.Fprintf(os.Stderr, "inspect: unknown format %s, expect text or json\n", *format)
+		return EXIT_USAGE
+	}
+
+	var reader *topicindex.Reader
+	var err error
+	if *manifestFileName != "" {
+		var manifest *topicindex.Manifest
+		if manifest, err = topicindex.ReadManifest(*manifestFileName); err != nil {
+			fmt.Fprintf(os.Stderr, "inspect failed: %v\n", err)
+			return EXIT_FAILURE
+		}
+		if *shard < 0 || *shard >= manifest.ShardCount {
+			fmt.Fprintf(os.Stderr, "inspect: -shard must be in [0, %d), got %d\n", manifest.ShardCount, *shard)
+			return EXIT_USAGE
+		}
+		reader, err = manifest.OpenShard(*shard, topicindex.Options{SkipVerify: *skipVerify})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "inspect failed: %v\n", err)
+			return EXIT_FAILURE
+		}
+	} else if reader, err = topicindex.OpenWithOptions(*indexFileName, topicindex.Options{SkipVerify: *skipVerify}); err != nil {
+		fmt.Fprintf(os.Stderr, "inspect failed: %v\n", err)
+		return EXIT_FAILURE
+	}
+	defer reader.Close()
+	var index topicindex.Index = reader
+	if *deltaFileName != "" {
+		deltaReader, err := topicindex.OpenWithOptions(*deltaFileName, topicindex.Options{SkipVerify: *skipVerify})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "inspect failed: %v\n", err)
+			return EXIT_FAILURE
+		}
+		defer deltaReader.Close()
+		if index, err = topicindex.NewOverlay(reader, deltaReader); err != nil {
+			fmt.Fprintf(os.Stderr, "inspect failed: %v\n", err)
+			return EXIT_FAILURE
+		}
+	}
+	var DocItemList []*DocItem
+	if *key != "" {
+		if DocItemList, err = index.Get(*key); err != nil {
+			fmt.Fprintf(os.Stderr, "inspect failed: %v\n", err)
+			return EXIT_FAILURE
+		}
+	}
+
+	buf_fw := bufio.NewWriter(os.Stdout)
+	if *format == "json" {
+		err = inspectAsJson(buf_fw, index, *key, DocItemList)
 	} else {
-		fmt.Printf("DOC_ITEM_SIZE write %d bytes successfully\n", len_w)
+		err = inspectAsText(buf_fw, index, *key, DocItemList)
 	}
-	for _, TopicVal := range TopicReshape {
-		// first writing key to file, key_len first, and then key_value
-		key := []byte("TOPIC_ALL" + "_8")
-		if err = WriteIndexDataToFile(buf_fw, key, TopicVal.DocList); err != nil {
+	if err == nil {
+		err = buf_fw.Flush()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "inspect failed: %v\n", err)
+		return EXIT_FAILURE
+	}
+	return EXIT_OK
+}
+
+func inspectAsJson(w *bufio.Writer, reader topicindex.Index, key string, DocItemList []*DocItem) error {
+	encoder := json.NewEncoder(w)
+	header := reader.Header()
+	headerRow := inspectHeaderRow{
+		Type:            "header",
+		Version:         header.Version,
+		ByteOrder:       header.Order.String(),
+		Flags:           header.Flags,
+		ItemSize:        header.ItemSize,
+		RecordCount:     header.RecordCount,
+		KeyDirectory:    header.Flags&topicindex.FLAG_KEY_DIRECTORY != 0,
+		SortVal:         header.HasSortVal(),
+		CompressedLists: header.HasCompressedLists(),
+		BlockSize:       header.BlockSize,
+		Settings:        header.Settings,
+	}
+	if header.WeightBuckets != nil {
+		headerRow.WeightFeature = header.WeightBuckets.Feature
+		headerRow.WeightBounds = header.WeightBuckets.Bounds
+	}
+	if header.Delta != nil {
+		headerRow.BaseChecksum = &header.Delta.BaseChecksum
+		headerRow.Removed = header.Delta.Removed
+	}
+	if err := encoder.Encode(headerRow); err != nil {
+		return err
+	}
+	for _, indexKey := range reader.Keys() {
+		count, err := reader.ListLen(indexKey)
+		if err != nil {
+			return err
+		}
+		row := inspectKeyRow{Type: "key", Key: indexKey, Count: count}
+		if total, err := reader.ListTotal(indexKey); err != nil {
+			return err
+		} else if total > count {
+			row.Total = total
+		}
+		if err := encoder.Encode(row); err != nil {
 			return err
 		}
 	}
-
-	for TopicHotId, TopicHotVal := range TopicHotReshape {
-		// first writing key to file, key_len first, and then key_value
-		key := []byte("TOPIC_" + strconv.FormatUint(TopicHotId, 10) + "_HOT_8")
-		if err = WriteIndexDataToFile(buf_fw, key, TopicHotVal.DocList); err != nil {
+	for rank, DocItemEle := range DocItemList {
+		row := inspectItemRow{Type: "item", Key: key, Rank: rank, Vid: DocItemEle.Vid, Weight: DocItemEle.Weight}
+		if header.HasSortVal() {
+			score := DocItemEle.SortVal
+			row.Score = &score
+		}
+		if err := encoder.Encode(row); err != nil {
 			return err
 		}
 	}
-	buf_fw.Flush()
-	for TopicTimeId, TopicTimeVal := range TopicTimeReshape {
-		// first writing key to file, key_len first, and then key_value
-		key := []byte("TOPIC_" + strconv.FormatUint(TopicTimeId, 10) + "_NEW_8")
-		if err = WriteIndexDataToFile(buf_fw, key, TopicTimeVal.DocList); err != nil {
+	return nil
+}
+
+func inspectAsText(w *bufio.Writer, reader topicindex.Index, key string, DocItemList []*DocItem) error {
+	header := reader.Header()
+	fmt.Fprintf(w, "version:      %d\n", header.Version)
+	fmt.Fprintf(w, "byte order:   %s\n", header.Order)
+	fmt.Fprintf(w, "flags:        %#x\n", header.Flags)
+	fmt.Fprintf(w, "item size:    %d\n", header.ItemSize)
+	fmt.Fprintf(w, "record count: %d\n", header.RecordCount)
+	if header.WeightBuckets != nil {
+		fmt.Fprintf(w, "weight:       %d buckets of %s\n", len(header.WeightBuckets.Bounds)+1, header.WeightBuckets.Feature)
+	}
+	if header.BlockSize != 0 {
+		fmt.Fprintf(w, "block size:   %d\n", header.BlockSize)
+	}
+	if header.Settings != "" {
+		fmt.Fprintf(w, "settings:     %s\n", header.Settings)
+	}
+	if header.Delta != nil {
+		fmt.Fprintf(w, "delta:        of the base with crc %08x, %d keys removed\n", header.Delta.BaseChecksum, len(header.Delta.Removed))
+		for _, removedKey := range header.Delta.Removed {
+			fmt.Fprintf(w, "  removed     %s\n", removedKey)
+		}
+	}
+	fmt.Fprintln(w)
+
+	table := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	if header.HasListTotal() {
+		fmt.Fprintln(table, "KEY\tCOUNT\tTOTAL")
+	} else {
+		fmt.Fprintln(table, "KEY\tCOUNT")
+	}
+	for _, indexKey := range reader.Keys() {
+		count, err := reader.ListLen(indexKey)
+		if err != nil {
+			return err
+		}
+		if !header.HasListTotal() {
+			fmt.Fprintf(table, "%s\t%d\n", indexKey, count)
+			continue
+		}
+		total, err := reader.ListTotal(indexKey)
+		if err != nil {
 			return err
 		}
+		fmt.Fprintf(table, "%s\t%d\t%d\n", indexKey, count, total)
 	}
-	buf_fw.Flush()
-	return err
+	if err := table.Flush(); err != nil {
+		return err
+	}
+	if key == "" {
+		return nil
+	}
+
+	fmt.Fprintf(w, "\n%s\n", key)
+	table = tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	columns := []string{"RANK", "VID", "WEIGHT"}
+	if header.WeightBuckets != nil {
+		columns = append(columns, "FEATURE")
+	}
+	if header.HasSortVal() {
+		columns = append(columns, "SCORE")
+	}
+	fmt.Fprintln(table, strings.Join(columns, "\t"))
+	for rank, DocItemEle := range DocItemList {
+		row := []string{strconv.Itoa(rank), strconv.FormatUint(DocItemEle.Vid, 10), strconv.Itoa(int(DocItemEle.Weight))}
+		if header.WeightBuckets != nil {
+			low, high := header.WeightBuckets.Range(DocItemEle.Weight)
+			row = append(row, fmt.Sprintf("[%g, %g)", low, high))
+		}
+		if header.HasSortVal() {
+			row = append(row, strconv.FormatUint(DocItemEle.SortVal, 10))
+		}
+		fmt.Fprintln(table, strings.Join(row, "\t"))
+	}
+	return table.Flush()
 }
 
-func LoadCtrIntData(FileName string, CtrIntReshape map[uint64]*ctrintpb.CtrInfo) error {
-	var err error = nil
-	fr, err := os.Open(FileName)
-	Check(err)
-	defer func() {
-		if err := fr.Close(); err != nil {
-			fmt.Println("close filename %s failed", FileName)
+func runDiff(args []string) int {
+	flags := flag.NewFlagSet("diff", flag.ContinueOnError)
+	oldFileName := flags.String("old", "", "index file to compare against, e.g. yesterday's dump")
+	newFileName := flags.String("new", "./data/dump_topic_index", "index file to compare")
+	newDeltaFileName := flags.String("new-delta", "", "delta file to apply to -new before comparing")
+	rankThreshold := flags.Int("rank-threshold", 10, "report vids whose rank moved by more positions")
+	format := flags.String("format", "text", "output format, text or json")
+	if err := flags.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return EXIT_OK
 		}
-	}()
-	content, err := ioutil.ReadAll(fr)
+		return EXIT_USAGE
+	}
+	if flags.NArg() != 0 {
+		fmt.Fprintf(os.Stderr, "diff: unexpected arguments %v\n", flags.Args())
+		return EXIT_USAGE
+	}
+	if *oldFileName == "" || *newFileName == "" {
+		fmt.Fprintln(os.Stderr, "diff: both -old and -new are required")
+		return EXIT_USAGE
+	}
+	if *format != "text" && *format != "json" {
+		fmt.Fprintf(os.Stderr, "diff: unknown format %s, expect text or json\n", *format)
+		return EXIT_USAGE
+	}
+	if *rankThreshold < 0 {
+		fmt.Fprintf(os.Stderr, "diff: -rank-threshold must not be negative, got %d\n", *rankThreshold)
+		return EXIT_USAGE
+	}
+
+	oldReader, err := topicindex.Open(*oldFileName)
 	if err != nil {
-		err = fmt.Errorf("read file error: %v", err)
-		return err
+		fmt.Fprintf(os.Stderr, "diff failed: %v\n", err)
+		return EXIT_FAILURE
 	}
-	startIndex := uint64(0)
-	dataLen := uint64(len(content))
-	var keyLen uint64
-	var key uint64
-	var valueLen uint64
-	var value []byte
-	const LEN_SIZE = uint64(UINT64_SIZE)
-	for startIndex < dataLen {
-		keyLen = BytesToUint64(content[startIndex : startIndex+LEN_SIZE])
-		startIndex += LEN_SIZE
-		key = BytesToUint64(content[startIndex : startIndex+keyLen])
-		startIndex += keyLen
-		valueLen = BytesToUint64(content[startIndex : startIndex+LEN_SIZE])
-		startIndex += LEN_SIZE
-		value = content[startIndex : startIndex+valueLen]
-		startIndex += valueLen
-		ctrPbPtr := &ctrintpb.CtrInfo{}
-		if err := proto.Unmarshal(value, ctrPbPtr); err != nil {
-			fmt.Printf("Failed to parse CtrInfo string: %v", err)
-		} else {
-			// fmt.Printf("key_len:%d, key:%d, value_len:%d, value:%v", keyLen, key, valueLen, *ctrPbPtr)
-			CtrIntReshape[key] = ctrPbPtr
+	defer oldReader.Close()
+	newReader, err := topicindex.Open(*newFileName)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "diff failed: %v\n", err)
+		return EXIT_FAILURE
+	}
+	defer newReader.Close()
+	var newIndex topicindex.Index = newReader
+	if *newDeltaFileName != "" {
+		deltaReader, err := topicindex.Open(*newDeltaFileName)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "diff failed: %v\n", err)
+			return EXIT_FAILURE
+		}
+		defer deltaReader.Close()
+		if newIndex, err = topicindex.NewOverlay(newReader, deltaReader); err != nil {
+			fmt.Fprintf(os.Stderr, "diff failed: %v\n", err)
+			return EXIT_FAILURE
 		}
 	}
-	return err
+	report, err := topicindex.Diff(oldReader, newIndex, topicindex.DiffOptions{RankThreshold: *rankThreshold})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "diff failed: %v\n", err)
+		return EXIT_FAILURE
+	}
+
+	buf_fw := bufio.NewWriter(os.Stdout)
+	if *format == "json" {
+		err = json.NewEncoder(buf_fw).Encode(report)
+	} else {
+		diffAsText(buf_fw, report)
+	}
+	if err == nil {
+		err = buf_fw.Flush()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "diff failed: %v\n", err)
+		return EXIT_FAILURE
+	}
+	return EXIT_OK
 }
 
-func LoadCtrVoteUpData(FileName string, CtrVoteUpReshape map[string]*ctrstrpb.CtrInfo) error {
-	var err error = nil
-	fr, err := os.Open(FileName)
-	Check(err)
+func diffAsText(w *bufio.Writer, report *topicindex.DiffReport) {
+	for _, added := range report.Added {
+		fmt.Fprintf(w, "added   %s (%d)\n", added.Key, added.Count)
+	}
+	for _, removed := range report.Removed {
+		fmt.Fprintf(w, "removed %s (%d)\n", removed.Key, removed.Count)
+	}
+	for _, changed := range report.Changed {
+		fmt.Fprintf(w, "changed %s (%d -> %d)\n", changed.Key, changed.OldLen, changed.NewLen)
+		if len(changed.Entered) > 0 {
+			fmt.Fprintf(w, "  entered %v\n", changed.Entered)
+		}
+		if len(changed.Left) > 0 {
+			fmt.Fprintf(w, "  left    %v\n", changed.Left)
+		}
+		for _, move := range changed.Moved {
+			fmt.Fprintf(w, "  moved   %d %d -> %d\n", move.Vid, move.OldRank, move.NewRank)
+		}
+		for _, rescored := range changed.Rescored {
+			fmt.Fprintf(w, "  rescored %d weight %d -> %d, sort_val %d -> %d\n", rescored.Vid,
+				rescored.OldWeight, rescored.NewWeight, rescored.OldSortVal, rescored.NewSortVal)
+		}
+	}
+	fmt.Fprintf(w, "%d added, %d removed, %d changed, %d unchanged\n",
+		len(report.Added), len(report.Removed), len(report.Changed), report.Unchanged)
+}
+
+// merge the dumps SourceFileNames into FileName, see topicindex.Merge for the policies
+func MergeTopicIndex(FileName string, SourceFileNames []string, Opts topicindex.MergeOptions) (stats *topicindex.MergeStats, err error) {
+	var sources []topicindex.Index
+	for _, sourceFileName := range SourceFileNames {
+		// creating the output would truncate a source that is still being read
+		if outInfo, statErr := os.Stat(FileName); statErr == nil {
+			if sourceInfo, statErr := os.Stat(sourceFileName); statErr == nil && os.SameFile(outInfo, sourceInfo) {
+				return nil, fmt.Errorf("output %s is also the source %s", FileName, sourceFileName)
+			}
+		}
+		reader, err := topicindex.Open(sourceFileName)
+		if err != nil {
+			return nil, fmt.Errorf("open merge source error: %v", err)
+		}
+		defer reader.Close()
+		sources = append(sources, reader)
+	}
+
+	fw, err := os.Create(FileName)
+	if err != nil {
+		err = fmt.Errorf("create index file error: %v", err)
+		return nil, err
+	}
 	defer func() {
-		if err := fr.Close(); err != nil {
-			fmt.Println("close filename %s failed", FileName)
+		if closeErr := fw.Close(); closeErr != nil && err == nil {
+			err = fmt.Errorf("close Filename %s failed, error is %v", FileName, closeErr)
 		}
 	}()
-	content, err := ioutil.ReadAll(fr)
+	if stats, err = topicindex.Merge(fw, sources, Opts); err != nil {
+		err = fmt.Errorf("merge into %s error: %v", FileName, err)
+		return nil, err
+	}
+	return stats, nil
+}
+
+func runMerge(args []string) int {
+	flags := flag.NewFlagSet("merge", flag.ContinueOnError)
+	outputFileName := flags.String("output", "", "index file to write")
+	compressLists := flags.Bool("compress-lists", false, "store the posting lists of the output compressed, see build -compress-lists")
+	blockSize := flags.Int("block-size", 0, "compress the records of the output in flate blocks, see build -block-size")
+	policy := flags.String("policy", topicindex.MERGE_ERROR, "what to do with a key of several dumps, any of "+
+		strings.Join(topicindex.MERGE_POLICIES, ",")+"; "+topicindex.TOPIC_ALL_KEY+" always gets the topics of every dump")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: merge -output FILE [flags] INDEX...\n")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return EXIT_OK
+		}
+		return EXIT_USAGE
+	}
+	if *outputFileName == "" || flags.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "merge: -output and at least one index file are required")
+		return EXIT_USAGE
+	}
+	known := false
+	for _, name := range topicindex.MERGE_POLICIES {
+		known = known || name == *policy
+	}
+	if !known {
+		fmt.Fprintf(os.Stderr, "merge: unknown policy %s, expect any of %s\n", *policy, strings.Join(topicindex.MERGE_POLICIES, ","))
+		return EXIT_USAGE
+	}
+	if *blockSize < 0 || *blockSize > topicindex.MAX_BLOCK_SIZE {
+		fmt.Fprintf(os.Stderr, "merge: -block-size must be in [0, %d], got %d\n", topicindex.MAX_BLOCK_SIZE, *blockSize)
+		return EXIT_USAGE
+	}
+
+	var outputFlags uint32
+	if *compressLists {
+		outputFlags |= topicindex.FLAG_COMPRESSED_LISTS
+	}
+	stats, err := MergeTopicIndex(*outputFileName, flags.Args(), topicindex.MergeOptions{Policy: *policy, Flags: outputFlags, BlockSize: uint32(*blockSize)})
 	if err != nil {
-		err = fmt.Errorf("read file error: %v", err)
-		return err
+		fmt.Fprintf(os.Stderr, "merge failed: %v\n", err)
+		return EXIT_FAILURE
 	}
-	startIndex := uint64(0)
-	dataLen := uint64(len(content))
-	var keyLen uint64
-	var key []byte
-	var valueLen uint64
-	const LEN_SIZE = uint64(UINT64_SIZE)
-	var value []byte
-	for startIndex < dataLen {
-		keyLen = BytesToUint64(content[startIndex : startIndex+LEN_SIZE])
-		startIndex += LEN_SIZE
-		key = content[startIndex : startIndex+keyLen]
-		startIndex += keyLen
-		valueLen = BytesToUint64(content[startIndex : startIndex+LEN_SIZE])
-		startIndex += LEN_SIZE
-		value = content[startIndex : startIndex+valueLen]
-		startIndex += valueLen
-		ctrPbPtr := &ctrstrpb.CtrInfo{}
-		if err = proto.Unmarshal(value, ctrPbPtr); err != nil {
-			fmt.Printf("Failed to parse CtrInfo string: %v", err)
-		} else if strings.Contains(string(key), CTR_VP_PREFIX) {
-			CtrVoteUpReshape[string(key)] = ctrPbPtr
-		} else {
-			fmt.Printf("key: %s is not matched which should contain %s\n",
-				string(key), CTR_VP_PREFIX)
+	fmt.Printf("merged %d dumps into %d keys, %d keys were in several dumps\n", flags.NArg(), stats.Keys, stats.Conflicts)
+	return EXIT_OK
+}
+
+// one record of a ctr file in json lines form, Key is the decimal uint64 for
+// CTR_KIND_INT files and the raw key, like vu_<vid>, for CTR_KIND_STR files
+type ctrJsonLine struct {
+	Key     string          `json:"key"`
+	CtrInfo json.RawMessage `json:"ctr_info"`
+}
+
+const (
+	CTR_KIND_INT = "int"
+	CTR_KIND_STR = "str"
+)
+
+func newCtrInfo(kind string) proto.Message {
+	if kind == CTR_KIND_INT {
+		return &ctrintpb.CtrInfo{}
+	}
+	return &ctrstrpb.CtrInfo{}
+}
+
+// convert json lines read from fr into a ctr key/value file written to fw
+func EncodeCtrData(fr io.Reader, fw io.Writer, kind string) (int64, error) {
+	scanner := bufio.NewScanner(bufio.NewReader(fr))
+	scanner.Buffer(make([]byte, 0, bufio.MaxScanTokenSize), MAX_LINE_SIZE)
+	writer := ctrkv.NewWriter(fw)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		var line ctrJsonLine
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			return writer.Records(), fmt.Errorf("line %d: unmarshal ctr json error: %v", lineNo, err)
+		}
+		key := []byte(line.Key)
+		if kind == CTR_KIND_INT {
+			intKey, err := strconv.ParseUint(line.Key, 10, 64)
+			if err != nil {
+				return writer.Records(), fmt.Errorf("line %d: key %s is not a uint64: %v", lineNo, line.Key, err)
+			}
+			key = Uint64ToBytes(ctrkv.BYTE_ORDER, intKey)
+		}
+		ctrPbPtr := newCtrInfo(kind)
+		if len(line.CtrInfo) > 0 {
+			if err := json.Unmarshal(line.CtrInfo, ctrPbPtr); err != nil {
+				return writer.Records(), fmt.Errorf("line %d: unmarshal ctr_info error: %v", lineNo, err)
+			}
+		}
+		value, err := proto.Marshal(ctrPbPtr)
+		if err != nil {
+			return writer.Records(), fmt.Errorf("line %d: marshal CtrInfo error: %v", lineNo, err)
+		}
+		if err := writer.Write(key, value); err != nil {
+			return writer.Records(), fmt.Errorf("line %d: write record error: %v", lineNo, err)
 		}
 	}
-	return err
+	if err := scanner.Err(); err != nil {
+		return writer.Records(), fmt.Errorf("reading ctr json error: %v", err)
+	}
+	return writer.Records(), writer.Flush()
+}
+
+// convert the ctr key/value file read from fr into json lines written to fw
+func DecodeCtrData(fr io.Reader, fw io.Writer, kind string) (int64, error) {
+	reader := ctrkv.NewReader(fr)
+	buf_fw := bufio.NewWriter(fw)
+	encoder := json.NewEncoder(buf_fw)
+	records := int64(0)
+	for reader.Next() {
+		line := ctrJsonLine{Key: string(reader.Key())}
+		if kind == CTR_KIND_INT {
+			if len(reader.Key()) != int(UINT64_SIZE) {
+				return records, fmt.Errorf("key at offset %d has %d bytes, expect a uint64", reader.Offset(), len(reader.Key()))
+			}
+			line.Key = strconv.FormatUint(BytesToUint64(ctrkv.BYTE_ORDER, reader.Key()), 10)
+		}
+		ctrPbPtr := newCtrInfo(kind)
+		if err := proto.Unmarshal(reader.Value(), ctrPbPtr); err != nil {
+			return records, fmt.Errorf("parse CtrInfo at offset %d error: %v", reader.Offset(), err)
+		}
+		ctrJson, err := json.Marshal(ctrPbPtr)
+		if err != nil {
+			return records, fmt.Errorf("marshal CtrInfo at offset %d error: %v", reader.Offset(), err)
+		}
+		line.CtrInfo = ctrJson
+		if err := encoder.Encode(line); err != nil {
+			return records, err
+		}
+		records++
+	}
+	if err := reader.Err(); err != nil {
+		return records, err
+	}
+	return records, buf_fw.Flush()
+}
+
+func runCtr(args []string) int {
+	flags := flag.NewFlagSet("ctr", flag.ContinueOnError)
+	mode := flags.String("mode", "decode", "encode: json lines to ctr file, decode: ctr file to json lines")
+	kind := flags.String("kind", CTR_KIND_STR, "key type of the ctr file, int (like ctr_url_kv) or str (like vu_vd)")
+	inFileName := flags.String("in", "-", "input file, - for stdin")
+	outFileName := flags.String("out", "-", "output file, - for stdout")
+	if err := flags.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return EXIT_OK
+		}
+		return EXIT_USAGE
+	}
+	if flags.NArg() != 0 {
+		fmt.Fprintf(os.Stderr, "ctr: unexpected arguments %v\n", flags.Args())
+		return EXIT_USAGE
+	}
+	if *mode != "encode" && *mode != "decode" {
+		fmt.Fprintf(os.Stderr, "ctr: unknown mode %s, expect encode or decode\n", *mode)
+		return EXIT_USAGE
+	}
+	if *kind != CTR_KIND_INT && *kind != CTR_KIND_STR {
+		fmt.Fprintf(os.Stderr, "ctr: unknown kind %s, expect %s or %s\n", *kind, CTR_KIND_INT, CTR_KIND_STR)
+		return EXIT_USAGE
+	}
+
+	fr := io.Reader(os.Stdin)
+	if *inFileName != "-" {
+		file, err := os.Open(*inFileName)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ctr failed: %v\n", err)
+			return EXIT_FAILURE
+		}
+		defer file.Close()
+		fr = file
+	}
+	fw := io.Writer(os.Stdout)
+	var outFile *os.File
+	if *outFileName != "-" {
+		file, err := os.Create(*outFileName)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ctr failed: %v\n", err)
+			return EXIT_FAILURE
+		}
+		outFile = file
+		fw = file
+	}
+
+	var records int64
+	var err error
+	if *mode == "encode" {
+		records, err = EncodeCtrData(fr, fw, *kind)
+	} else {
+		records, err = DecodeCtrData(fr, fw, *kind)
+	}
+	if outFile != nil {
+		if closeErr := outFile.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ctr failed after %d records: %v\n", records, err)
+		return EXIT_FAILURE
+	}
+	fmt.Fprintf(os.Stderr, "ctr %s %d records\n", *mode, records)
+	return EXIT_OK
 }
 
-func ExecuteProcess(TopicFileName, CtrIntFileName, CtrStrFileName,
-	MicroVideoFileName, DumpTopicFileName string) {
-	// must load MicroVideoData first to create MicroVideoReshape
-	LoadMicroVideoData(MicroVideoFileName, MicroVideoReshape)
-	LoadCtrIntData(CtrIntFileName, CtrIntReshape)
-	LoadCtrVoteUpData(CtrStrFileName, CtrVoteUpReshape)
-	LoadTopicData(TopicFileName, MicroVideoReshape, TopicTimeReshape,
-		TopicHotReshape, TopicReshape, CtrIntReshape, CtrVoteUpReshape)
-	DumpTopicIndex(DumpTopicFileName, TopicHotReshape, TopicTimeReshape, TopicReshape)
+func run(args []string) int {
+	if len(args) == 0 {
+		usage()
+		return EXIT_USAGE
+	}
+	switch args[0] {
+	case "build":
+		return runBuild(args[1:])
+	case "inspect":
+		return runInspect(args[1:])
+	case "diff":
+		return runDiff(args[1:])
+	case "merge":
+		return runMerge(args[1:])
+	case "ctr":
+		return runCtr(args[1:])
+	case "-h", "-help", "--help", "help":
+		usage()
+		return EXIT_OK
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %s\n", args[0])
+		usage()
+		return EXIT_USAGE
+	}
 }
 
 func main() {
-	var TopicFileName string = "./data/topic_data"
-	var MicroVideoFileName string = "./data/content_model_cache.data"
-	var DumpTopicFileName string = "./data/dump_topic_index"
-	var CtrIntFileName string = "./data/ctr_url_kv"
-	var CtrStrFileName string = "./data/vu_vd"
-	ExecuteProcess(TopicFileName, CtrIntFileName, CtrStrFileName,
-		MicroVideoFileName, DumpTopicFileName)
+	os.Exit(run(os.Args[1:]))
 }
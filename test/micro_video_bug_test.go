@@ -0,0 +1,640 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	"write_index/ctrkv"
+	ctrintpb "write_index/protobuf/ctrint_reduce"
+	ctrstrpb "write_index/protobuf/ctrstr_reduce"
+	"write_index/topicindex"
+)
+
+// ctr files are little endian whatever the host
+func TestCtrByteOrder(t *testing.T) {
+	buf := Uint64ToBytes(ctrkv.BYTE_ORDER, 0x0102030405060708)
+	if want := []byte{8, 7, 6, 5, 4, 3, 2, 1}; !bytes.Equal(buf, want) {
+		t.Fatalf("Uint64ToBytes = %x, want %x", buf, want)
+	}
+	if got := BytesToUint64(ctrkv.BYTE_ORDER, buf); got != 0x0102030405060708 {
+		t.Fatalf("BytesToUint64 = %#x", got)
+	}
+	if got := BytesToUint32(ctrkv.BYTE_ORDER, Uint32ToBytes(ctrkv.BYTE_ORDER, 0xA1B2C3D4)); got != 0xA1B2C3D4 {
+		t.Fatalf("BytesToUint32 = %#x", got)
+	}
+	if got := BytesToFloat64(ctrkv.BYTE_ORDER, Float64ToBytes(ctrkv.BYTE_ORDER, -1.25)); got != -1.25 {
+		t.Fatalf("BytesToFloat64 = %v", got)
+	}
+	if got := BytesToFloat32(ctrkv.BYTE_ORDER, Float32ToBytes(ctrkv.BYTE_ORDER, 0.5)); got != 0.5 {
+		t.Fatalf("BytesToFloat32 = %v", got)
+	}
+}
+
+func randomDocList(rng *rand.Rand, count, scores int) []*DocItem {
+	DocList := make([]*DocItem, count)
+	for index := range DocList {
+		DocList[index] = &DocItem{Vid: uint64(index), SortVal: uint64(rng.Intn(scores))}
+	}
+	return DocList
+}
+
+// the heap path, the stable sort path and the plain sort must pick the same K
+func TestSelectTopK(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for round := 0; round < 2000; round++ {
+		count := rng.Intn(300)
+		K := rng.Intn(80) - 5
+		DocList := randomDocList(rng, count, 1+rng.Intn(20))
+		want := append([]*DocItem(nil), DocList...)
+		sort.Stable(ByScoreDescending(want))
+		if K > 0 && K < count {
+			want = want[:K]
+		}
+
+		got := selectTopK(append([]*DocItem(nil), DocList...), K)
+		if len(got) != len(want) {
+			t.Fatalf("count %d, K %d: got %d items, want %d", count, K, len(got), len(want))
+		}
+		for index := range got {
+			// equal SortVals keep the input order, cut or not
+			if got[index] != want[index] {
+				t.Fatalf("count %d, K %d: item %d is vid %d score %d, want vid %d score %d", count, K, index,
+					got[index].Vid, got[index].SortVal, want[index].Vid, want[index].SortVal)
+			}
+		}
+	}
+}
+
+func TestDiversifyByAuthor(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+	for round := 0; round < 3000; round++ {
+		DocList := randomDocList(rng, rng.Intn(80), 1)
+		authors := make(map[uint64]string, len(DocList))
+		authorCount := 1 + rng.Intn(8)
+		for _, DocItemEle := range DocList {
+			// some vids have no author and are never limited
+			if rng.Intn(8) > 0 {
+				authors[DocItemEle.Vid] = "author" + strconv.Itoa(rng.Intn(authorCount))
+			}
+		}
+		authorOf := func(vid uint64) string {
+			if author, ok := authors[vid]; ok {
+				return author
+			}
+			return "vid:" + strconv.FormatUint(vid, 10)
+		}
+		Window, MaxPerAuthor := 1+rng.Intn(8), 1+rng.Intn(3)
+
+		reranked, demoted := diversifyByAuthor(append([]*DocItem(nil), DocList...), Window, MaxPerAuthor, func(vid uint64) string {
+			return authors[vid]
+		})
+		if len(reranked) != len(DocList) {
+			t.Fatalf("round %d: %d vids in, %d out", round, len(DocList), len(reranked))
+		}
+		if Window <= MaxPerAuthor {
+			for index := range reranked {
+				if reranked[index] != DocList[index] {
+					t.Fatalf("round %d: window %d <= max %d must keep the order", round, Window, MaxPerAuthor)
+				}
+			}
+			continue
+		}
+
+		placed := make(map[uint64]bool, len(DocList))
+		lastRank := make(map[string]uint64, 0)
+		wantDemoted := 0
+		for position, DocItemEle := range reranked {
+			if placed[DocItemEle.Vid] {
+				t.Fatalf("round %d: vid %d placed twice", round, DocItemEle.Vid)
+			}
+			// the vids of one author keep their order
+			author := authorOf(DocItemEle.Vid)
+			if last, ok := lastRank[author]; ok && last > DocItemEle.Vid {
+				t.Fatalf("round %d: %s vids out of order at position %d", round, author, position)
+			}
+			lastRank[author] = DocItemEle.Vid
+			if int(DocItemEle.Vid) < position {
+				wantDemoted++
+			}
+
+			// authors of the Window-1 positions above
+			inWindow := make(map[string]int, Window)
+			for above := position - Window + 1; above < position; above++ {
+				if above >= 0 {
+					inWindow[authorOf(reranked[above].Vid)]++
+				}
+			}
+			// the best ranked vid not placed yet whose author is below the limit
+			best := -1
+			for rank := range DocList {
+				if !placed[uint64(rank)] && inWindow[authorOf(uint64(rank))] < MaxPerAuthor {
+					best = rank
+					break
+				}
+			}
+			if best >= 0 && DocItemEle.Vid != uint64(best) {
+				t.Fatalf("round %d: position %d took vid %d, vid %d was eligible", round, position, DocItemEle.Vid, best)
+			}
+			if best < 0 {
+				// every author left is at the limit, the best ranked vid is placed anyway
+				for rank := range DocList {
+					if !placed[uint64(rank)] {
+						if DocItemEle.Vid != uint64(rank) {
+							t.Fatalf("round %d: position %d took vid %d, want the best ranked vid %d", round, position, DocItemEle.Vid, rank)
+						}
+						break
+					}
+				}
+			}
+			placed[DocItemEle.Vid] = true
+		}
+		if demoted != wantDemoted {
+			t.Fatalf("round %d: demoted %d, want %d", round, demoted, wantDemoted)
+		}
+	}
+}
+
+func TestTrendScorer(t *testing.T) {
+	const buildTime = 1700000000
+	scorer := DefaultTrendScorer()
+	halfLife := int64(scorer.HalfLife / time.Second)
+	tests := []struct {
+		name        string
+		publishTime int64
+		decay       float64
+	}{
+		{"published at the build", buildTime, 1},
+		{"published in the future", buildTime + 3600, 1},
+		{"one half life old", buildTime - halfLife, 0.5},
+		{"two half lives old", buildTime - 2*halfLife, 0.25},
+	}
+	for _, test := range tests {
+		input := &ScoreInput{
+			Video:     &MicroVideoItem{PlayCnt: 100, CommentCnt: 2, PublishTime: uint64(test.publishTime)},
+			BuildTime: buildTime,
+		}
+		if decay := scorer.Decay(input); math.Abs(decay-test.decay) > 1e-12 {
+			t.Errorf("%s: Decay = %v, want %v", test.name, decay, test.decay)
+		}
+		engagement := scorer.PlayWeight*100 + scorer.CommentWeight*2
+		if score, want := scorer.Score(input), uint64(math.Round(engagement*test.decay*TREND_SCORE_SCALE)); score != want {
+			t.Errorf("%s: Score = %d, want %d", test.name, score, want)
+		}
+		if weight, want := scorer.Weight(input), uint8(math.Round(test.decay*math.MaxUint8)); weight != want {
+			t.Errorf("%s: Weight = %d, want %d", test.name, weight, want)
+		}
+	}
+	if !scorer.UsesBuildTime() {
+		t.Error("the trend scorer must report that it uses the build time")
+	}
+}
+
+// the trend list is scored at the build time and not at the time the test runs
+func TestTrendListFollowsBuildTime(t *testing.T) {
+	const published = 1700000000
+	videos := map[uint64]MicroVideoItem{
+		1: {Mthid: "1", PlayCnt: 10000, PublishTime: published},
+		2: {Mthid: "2", PlayCnt: 1000, CommentCnt: 5, PublishTime: published + 3600},
+	}
+	voteUp := map[string]*ctrstrpb.CtrInfo{CTR_VP_PREFIX + "1": {}, CTR_VP_PREFIX + "2": {}}
+	task := &topicTask{TopicId: 9, Item: TopicItem{TopicId: "9", VidList: []string{"2", "1"}}}
+	scorer := DefaultTrendScorer()
+	halfLife := int64(scorer.HalfLife / time.Second)
+	for _, buildTime := range []int64{published, published + 3600, published + halfLife, published + 10*halfLife} {
+		ListOpts := &TopicListOptions{MinimalVids: 1, BuildTime: buildTime, Scorers: []Scorer{scorer}}
+		var stats BuildStats
+		DocList := buildTopicLists(task, ListOpts, &stats, videos, nil, voteUp)[LIST_TYPE_TREND].DocList
+		if len(DocList) != 2 || DocList[0].Vid != 1 || DocList[1].Vid != 2 {
+			t.Fatalf("build time %d: trend list %+v, want vid 1 then vid 2", buildTime, DocList)
+		}
+		for _, DocItemEle := range DocList {
+			Video := videos[DocItemEle.Vid]
+			input := &ScoreInput{Vid: DocItemEle.Vid, Video: &Video, BuildTime: buildTime, VoteUp: voteUp[CTR_VP_PREFIX+strconv.FormatUint(DocItemEle.Vid, 10)]}
+			if DocItemEle.SortVal != scorer.Score(input) || DocItemEle.Weight != scorer.Weight(input) {
+				t.Errorf("build time %d: vid %d scored %d weight %d, want %d weight %d", buildTime, DocItemEle.Vid,
+					DocItemEle.SortVal, DocItemEle.Weight, scorer.Score(input), scorer.Weight(input))
+			}
+		}
+	}
+}
+
+// every input that fails is reported, not only the first one
+func TestLoadBuildInputs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "load_build_inputs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	opts := BuildOptions{
+		MicroVideoFileName: filepath.Join(dir, "missing_micro_video"),
+		CtrIntFileName:     filepath.Join(dir, "truncated_ctr_int"),
+		CtrStrFileName:     filepath.Join(dir, "empty_ctr_str"),
+	}
+	if err := ioutil.WriteFile(opts.CtrIntFileName, []byte{1, 2, 3}, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(opts.CtrStrFileName, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	err = LoadBuildInputs(opts)
+	var errs LoadErrors
+	if !errors.As(err, &errs) || len(errs) != 2 {
+		t.Fatalf("LoadBuildInputs = %v, want the errors of two inputs", err)
+	}
+	for index, fileName := range []string{opts.MicroVideoFileName, opts.CtrIntFileName} {
+		if !strings.Contains(errs[index].Error(), fileName) {
+			t.Errorf("error %d %q does not name %s", index, errs[index], fileName)
+		}
+	}
+}
+
+// the first failure stops the other loaders, which do not add their cancellation to the errors
+func TestRunLoadersCancels(t *testing.T) {
+	badInput := errors.New("bad input")
+	waitForCancel := func(ctx context.Context) error {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("stopped: %w", ctx.Err())
+		case <-time.After(10 * time.Second):
+			return errors.New("not cancelled")
+		}
+	}
+	err := runLoaders([]func(context.Context) error{
+		waitForCancel,
+		func(context.Context) error { return badInput },
+		waitForCancel,
+	})
+	var errs LoadErrors
+	if !errors.As(err, &errs) || len(errs) != 1 || errs[0] != badInput {
+		t.Fatalf("runLoaders = %v, want only %v", err, badInput)
+	}
+	if err := runLoaders([]func(context.Context) error{func(context.Context) error { return nil }}); err != nil {
+		t.Fatalf("runLoaders without failures = %v", err)
+	}
+}
+
+// the lists and stats do not depend on how many workers built them
+func TestLoadTopicDataWorkers(t *testing.T) {
+	rng := rand.New(rand.NewSource(3))
+	videos := make(map[uint64]MicroVideoItem, 400)
+	voteUp := make(map[string]*ctrstrpb.CtrInfo, 400)
+	for vid := uint64(1); vid <= 400; vid++ {
+		videos[vid] = MicroVideoItem{
+			Title:       "title " + strconv.Itoa(rng.Intn(100)),
+			Vid:         strconv.FormatUint(vid, 10),
+			TitleSign:   uint64(rng.Intn(300)),
+			Mthid:       strconv.Itoa(rng.Intn(20)),
+			PlayCnt:     uint64(rng.Intn(100000)),
+			CommentCnt:  uint64(rng.Intn(100)),
+			PublishTime: uint64(1700000000 + rng.Intn(86400*30)),
+		}
+		click := int64(rng.Intn(1000))
+		voteUp[CTR_VP_PREFIX+strconv.FormatUint(vid, 10)] = &ctrstrpb.CtrInfo{Click: &click}
+	}
+	var lines []byte
+	for topic := 1; topic <= 300; topic++ {
+		item := TopicItem{TopicId: strconv.Itoa(topic), Title: "topic " + strconv.Itoa(topic)}
+		for count := rng.Intn(40); count > 0; count-- {
+			item.VidList = append(item.VidList, strconv.Itoa(1+rng.Intn(450)))
+		}
+		line, err := json.Marshal(item)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines = append(append(lines, line...), '\n')
+	}
+	dir, err := ioutil.TempDir("", "load_topic_data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fileName := filepath.Join(dir, "topic_data")
+	if err := ioutil.WriteFile(fileName, lines, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var scorers []Scorer
+	for _, name := range []string{LIST_TYPE_HOT, LIST_TYPE_NEW, LIST_TYPE_CTR, LIST_TYPE_TREND} {
+		scorer, ok := LookupScorer(name)
+		if !ok {
+			t.Fatalf("no scorer %s", name)
+		}
+		scorers = append(scorers, scorer)
+	}
+	ListOpts := &TopicListOptions{
+		MinimalVids: 3,
+		BuildTime:   1700000000 + 86400*30,
+		Scorers:     scorers,
+		MaxListLen:  map[string]int{LIST_TYPE_HOT: 10},
+		Diversity:   &DiversityOptions{Window: 4, MaxPerAuthor: 1, ListTypes: map[string]bool{LIST_TYPE_HOT: true}},
+		Dedup:       &DedupOptions{TitleSign: true, SimhashDistance: 3},
+	}
+	type build struct {
+		stats            *BuildStats
+		TopicListReshape map[string]map[uint64]*TopicIndexItem
+		TopicReshape     map[uint64]*TopicIndexItem
+	}
+	var builds []build
+	for _, workers := range []int{1, 8} {
+		current := build{TopicListReshape: map[string]map[uint64]*TopicIndexItem{}, TopicReshape: map[uint64]*TopicIndexItem{}}
+		current.stats, err = LoadTopicData(fileName, workers, ListOpts, videos, current.TopicListReshape, current.TopicReshape, nil, voteUp)
+		if err != nil {
+			t.Fatalf("workers %d: %v", workers, err)
+		}
+		builds = append(builds, current)
+	}
+	if builds[0].stats.Topics == 0 || len(builds[0].stats.DuplicatesDropped) == 0 || len(builds[0].stats.DiversityDemoted) == 0 {
+		t.Fatalf("the input must exercise the build, stats %+v", builds[0].stats)
+	}
+	if !reflect.DeepEqual(builds[0], builds[1]) {
+		t.Fatalf("workers 1 and 8 built different lists, stats %+v and %+v", builds[0].stats, builds[1].stats)
+	}
+}
+
+// a vote up record without clicks scores 0 instead of panicking
+func TestComputeScoreForHot(t *testing.T) {
+	Video := &MicroVideoItem{Vid: "1"}
+	click := int64(42)
+	for _, test := range []struct {
+		ctr  *ctrstrpb.CtrInfo
+		want uint64
+	}{{&ctrstrpb.CtrInfo{Click: &click}, 42}, {&ctrstrpb.CtrInfo{}, 0}, {nil, 0}} {
+		if score := Video.ComputeScoreForHot(test.ctr); score != test.want {
+			t.Errorf("ctr %v: score %d, want %d", test.ctr, score, test.want)
+		}
+	}
+}
+
+func TestCtrScorer(t *testing.T) {
+	ctr := func(click, show int64) *ctrintpb.CtrInfo {
+		return &ctrintpb.CtrInfo{Click: &click, Show: &show}
+	}
+	bayes := DefaultCtrScorer()
+	wilson := DefaultCtrScorer()
+	wilson.Method = CTR_METHOD_WILSON
+	noPrior := DefaultCtrScorer()
+	noPrior.Method, noPrior.PriorShows = CTR_METHOD_WILSON, 0
+	// the lower bound of 5 clicks in 100 shows, the prior of the default scorer
+	const wilsonPrior = 0.021543361456313564
+	tests := []struct {
+		name   string
+		scorer *CtrScorer
+		ctr    *ctrintpb.CtrInfo
+		want   float64
+	}{
+		{"bayes without ctr", bayes, nil, 0.05},
+		{"bayes without shows", bayes, &ctrintpb.CtrInfo{}, 0.05},
+		{"bayes", bayes, ctr(10, 100), 0.075},
+		{"bayes clicks without shows", bayes, ctr(5, 0), 10.0 / 105},
+		{"bayes negative", bayes, ctr(-1, 100), 0.05},
+		// a vid without ctr must not outrank a vid with the same rate and more shows
+		{"wilson without ctr", wilson, nil, wilsonPrior},
+		{"wilson without shows", wilson, &ctrintpb.CtrInfo{}, wilsonPrior},
+		{"wilson negative", wilson, ctr(1, -1), wilsonPrior},
+		{"wilson", wilson, ctr(10, 100), 0.05522854161313613},
+		{"wilson clicks without shows", wilson, ctr(3, 0), 0.4384939195509822},
+		{"wilson without prior shows", noPrior, nil, 0},
+	}
+	for _, test := range tests {
+		if err := test.scorer.Validate(); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if rate := test.scorer.Rate(test.ctr); math.Abs(rate-test.want) > 1e-12 {
+			t.Errorf("%s: Rate = %v, want %v", test.name, rate, test.want)
+		}
+		input := &ScoreInput{CtrInt: test.ctr}
+		if score, want := test.scorer.Score(input), uint64(math.Round(test.want*CTR_SCORE_SCALE)); score != want {
+			t.Errorf("%s: Score = %d, want %d", test.name, score, want)
+		}
+	}
+	if prior, rate := wilson.Rate(nil), wilson.Rate(ctr(5, 100)); prior != rate {
+		t.Errorf("wilson scores a vid without ctr %v and the prior counts %v", prior, rate)
+	}
+}
+
+func TestDedupList(t *testing.T) {
+	// vids 1 to 6 sorted by score, vid 7 has no title key
+	titles := map[uint64]titleKey{
+		1: {TitleSign: 10, Simhash: 0x00, HasSimhash: true},
+		2: {TitleSign: 10, Simhash: 0xF000, HasSimhash: true},
+		3: {TitleSign: 0, Simhash: 0x07, HasSimhash: true},
+		4: {TitleSign: 0, Simhash: 0x0F, HasSimhash: true},
+		5: {TitleSign: 20},
+		6: {TitleSign: 20, Simhash: 0x01, HasSimhash: true},
+	}
+	tests := []struct {
+		name string
+		opts DedupOptions
+		want []uint64
+	}{
+		{"nothing", DedupOptions{SimhashDistance: -1}, []uint64{1, 2, 3, 4, 5, 6, 7}},
+		// a zero sign is no sign, the better scored vid of a sign stays
+		{"title sign", DedupOptions{TitleSign: true, SimhashDistance: -1}, []uint64{1, 3, 4, 5, 7}},
+		{"simhash", DedupOptions{SimhashDistance: 3}, []uint64{1, 2, 4, 5, 7}},
+		{"simhash exact", DedupOptions{SimhashDistance: 0}, []uint64{1, 2, 3, 4, 5, 6, 7}},
+		// vid 4 is 1 bit from the dropped vid 3 but 4 bits from the kept vid 1
+		{"both", DedupOptions{TitleSign: true, SimhashDistance: 3}, []uint64{1, 4, 5, 7}},
+		{"wide simhash", DedupOptions{TitleSign: true, SimhashDistance: 4}, []uint64{1, 5, 7}},
+	}
+	for _, test := range tests {
+		var DocList []*DocItem
+		for vid := uint64(1); vid <= 7; vid++ {
+			DocList = append(DocList, &DocItem{Vid: vid, SortVal: 10 - vid})
+		}
+		// as newTitleKey leaves out what the options do not compare
+		keys := make(map[uint64]titleKey, len(titles))
+		for vid, key := range titles {
+			if !test.opts.TitleSign {
+				key.TitleSign = 0
+			}
+			if test.opts.SimhashDistance < 0 {
+				key.Simhash, key.HasSimhash = 0, false
+			}
+			keys[vid] = key
+		}
+		kept, dropped := dedupList(DocList, &test.opts, keys)
+		var got []uint64
+		for _, DocItemEle := range kept {
+			got = append(got, DocItemEle.Vid)
+		}
+		if !reflect.DeepEqual(got, test.want) || dropped != 7-len(test.want) {
+			t.Errorf("%s: kept %v, dropped %d, want %v", test.name, got, dropped, test.want)
+		}
+	}
+}
+
+// the best scored copy of a title is kept whatever the file order, and each list counts its own drops
+func TestDedupStats(t *testing.T) {
+	videos := map[uint64]MicroVideoItem{
+		1: {Title: "funny cat", TitleSign: 7, Mthid: "1", PlayCnt: 10, PublishTime: 300},
+		2: {Title: "Funny cat!", TitleSign: 8, Mthid: "2", PlayCnt: 30, PublishTime: 200},
+		3: {Title: "another title", TitleSign: 7, Mthid: "3", PlayCnt: 20, PublishTime: 100},
+	}
+	voteUp := map[string]*ctrstrpb.CtrInfo{}
+	for vid, video := range videos {
+		click := int64(video.PlayCnt)
+		voteUp[CTR_VP_PREFIX+strconv.FormatUint(vid, 10)] = &ctrstrpb.CtrInfo{Click: &click}
+	}
+	var scorers []Scorer
+	for _, name := range []string{LIST_TYPE_HOT, LIST_TYPE_NEW} {
+		scorer, ok := LookupScorer(name)
+		if !ok {
+			t.Fatalf("no scorer %s", name)
+		}
+		scorers = append(scorers, scorer)
+	}
+	tests := []struct {
+		name    string
+		opts    DedupOptions
+		hot     []uint64
+		new     []uint64
+		dropped map[string]int
+	}{
+		{"title sign", DedupOptions{TitleSign: true, SimhashDistance: -1}, []uint64{2, 3}, []uint64{1, 2},
+			map[string]int{LIST_TYPE_HOT: 1, LIST_TYPE_NEW: 1}},
+		{"simhash", DedupOptions{SimhashDistance: 0}, []uint64{2, 3}, []uint64{1, 3},
+			map[string]int{LIST_TYPE_HOT: 1, LIST_TYPE_NEW: 1}},
+		{"both", DedupOptions{TitleSign: true, SimhashDistance: 0}, []uint64{2, 3}, []uint64{1},
+			map[string]int{LIST_TYPE_HOT: 1, LIST_TYPE_NEW: 2}},
+	}
+	for _, test := range tests {
+		task := &topicTask{TopicId: 5, Item: TopicItem{TopicId: "5", VidList: []string{"1", "2", "3"}}}
+		ListOpts := &TopicListOptions{MinimalVids: 1, Scorers: scorers, Dedup: &test.opts}
+		var stats BuildStats
+		lists := buildTopicLists(task, ListOpts, &stats, videos, nil, voteUp)
+		for name, want := range map[string][]uint64{LIST_TYPE_HOT: test.hot, LIST_TYPE_NEW: test.new} {
+			var got []uint64
+			for _, DocItemEle := range lists[name].DocList {
+				got = append(got, DocItemEle.Vid)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("%s: %s list %v, want %v", test.name, name, got, want)
+			}
+		}
+		if !reflect.DeepEqual(stats.DuplicatesDropped, test.dropped) {
+			t.Errorf("%s: DuplicatesDropped %v, want %v", test.name, stats.DuplicatesDropped, test.dropped)
+		}
+	}
+}
+
+// a topic whose vid list changed since the base is rebuilt, the others are reused
+func TestIncrementalBuild(t *testing.T) {
+	dir, err := ioutil.TempDir("", "incremental_build")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeLines := func(name string, items ...interface{}) string {
+		var lines []byte
+		for _, item := range items {
+			line, err := json.Marshal(item)
+			if err != nil {
+				t.Fatal(err)
+			}
+			lines = append(append(lines, line...), '\n')
+		}
+		fileName := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(fileName, lines, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return fileName
+	}
+	var videos []interface{}
+	for vid := 1; vid <= 6; vid++ {
+		videos = append(videos, MicroVideoItem{Vid: strconv.Itoa(vid), Mthid: strconv.Itoa(vid), PlayCnt: uint64(vid * 100), PublishTime: uint64(1700000000 + vid)})
+	}
+	opts := BuildOptions{
+		MicroVideoFileName: writeLines("video", videos...),
+		CtrIntFileName:     writeLines("ctr_int"),
+		CtrStrFileName:     writeLines("ctr_str"),
+		ListTypes:          LIST_TYPES,
+		MinimalVids:        1,
+		Workers:            2,
+		Clock:              func() time.Time { return time.Unix(1700086400, 0) },
+	}
+	build := func(opts BuildOptions, topics ...TopicItem) *BuildStats {
+		t.Helper()
+		// the build fills the package maps, start each one afresh
+		TopicListReshape = make(map[string]map[uint64]*TopicIndexItem, 0)
+		TopicReshape = make(map[uint64]*TopicIndexItem, 0)
+		var items []interface{}
+		for _, topic := range topics {
+			items = append(items, topic)
+		}
+		opts.TopicFileName = writeLines("topic", items...)
+		stats, err := ExecuteProcess(opts)
+		if err != nil {
+			t.Fatalf("build %s: %v", opts.DumpTopicFileName, err)
+		}
+		return stats
+	}
+	same := func(name string, got topicindex.Index, wantFileName string) {
+		t.Helper()
+		want, err := topicindex.Open(wantFileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer want.Close()
+		report, err := topicindex.Diff(want, got, topicindex.DiffOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(report.Added) != 0 || len(report.Removed) != 0 || len(report.Changed) != 0 {
+			t.Errorf("%s differs from a full build: %+v", name, report)
+		}
+	}
+
+	baseOpts := opts
+	baseOpts.DumpTopicFileName = filepath.Join(dir, "base")
+	build(baseOpts, TopicItem{TopicId: "1", VidList: []string{"1", "2", "3"}}, TopicItem{TopicId: "2", VidList: []string{"4", "5", "6"}})
+	changed := []TopicItem{{TopicId: "1", VidList: []string{"1", "2"}}, {TopicId: "2", VidList: []string{"4", "5", "6"}}}
+	fullOpts := opts
+	fullOpts.DumpTopicFileName = filepath.Join(dir, "full")
+	build(fullOpts, changed...)
+
+	incrementalOpts := opts
+	incrementalOpts.DumpTopicFileName = filepath.Join(dir, "incremental")
+	incrementalOpts.BaseFileName = baseOpts.DumpTopicFileName
+	if stats := build(incrementalOpts, changed...); stats.ReusedTopics != 1 || stats.Topics != 1 {
+		t.Errorf("incremental build reused %d and built %d topics, want 1 and 1", stats.ReusedTopics, stats.Topics)
+	}
+	incremental, err := topicindex.Open(incrementalOpts.DumpTopicFileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer incremental.Close()
+	same("incremental build", incremental, fullOpts.DumpTopicFileName)
+
+	deltaOpts := incrementalOpts
+	deltaOpts.DumpTopicFileName = filepath.Join(dir, "delta")
+	deltaOpts.Delta = true
+	build(deltaOpts, changed...)
+	base, err := topicindex.Open(baseOpts.DumpTopicFileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer base.Close()
+	delta, err := topicindex.Open(deltaOpts.DumpTopicFileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer delta.Close()
+	overlay, err := topicindex.NewOverlay(base, delta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	same("base with the delta", overlay, fullOpts.DumpTopicFileName)
+}
@@ -0,0 +1,292 @@
+// Package scoreexpr parses and evaluates the small arithmetic expressions used
+// to define topic list scores in the build config, for example
+//
+//	Click + 0.5*log1p(PlayCnt) - CommentCnt/100
+//
+// An expression is made of float64 numbers, variables, the operators + - * /
+// and parentheses, and calls of the functions in FUNCTIONS. Variables are
+// resolved when the expression is parsed, so a typo is reported at startup
+// instead of silently scoring 0.
+package scoreexpr
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// SyntaxError points at the column of an expression that cannot be parsed
+type SyntaxError struct {
+	Source string
+	Column int
+	Msg    string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("column %d: %s\n\t%s\n\t%s^", e.Column, e.Msg, e.Source, strings.Repeat(" ", e.Column-1))
+}
+
+type function struct {
+	arity int
+	call  func(args []float64) float64
+}
+
+// FUNCTIONS are the functions an expression can call
+var FUNCTIONS = map[string]function{
+	"abs":   {1, func(args []float64) float64 { return math.Abs(args[0]) }},
+	"sqrt":  {1, func(args []float64) float64 { return math.Sqrt(args[0]) }},
+	"log":   {1, func(args []float64) float64 { return math.Log(args[0]) }},
+	"log1p": {1, func(args []float64) float64 { return math.Log1p(args[0]) }},
+	"log2":  {1, func(args []float64) float64 { return math.Log2(args[0]) }},
+	"log10": {1, func(args []float64) float64 { return math.Log10(args[0]) }},
+	"exp":   {1, func(args []float64) float64 { return math.Exp(args[0]) }},
+	"pow":   {2, func(args []float64) float64 { return math.Pow(args[0], args[1]) }},
+	"min":   {2, func(args []float64) float64 { return math.Min(args[0], args[1]) }},
+	"max":   {2, func(args []float64) float64 { return math.Max(args[0], args[1]) }},
+}
+
+// Expr is a parsed expression, safe for concurrent Eval
+type Expr struct {
+	source string
+	root   node
+	// names of the variables the expression reads
+	used map[string]bool
+}
+
+// Parse parses source, variables lists the names it may use, in the order their
+// values are later passed to Eval
+func Parse(source string, variables []string) (*Expr, error) {
+	parser := &parser{source: source, variables: make(map[string]int, len(variables)), used: make(map[string]bool, 0)}
+	for index, name := range variables {
+		parser.variables[name] = index
+	}
+	parser.next()
+	if parser.token.kind == tokenEnd {
+		return nil, parser.errorf(parser.token, "empty expression")
+	}
+	root, err := parser.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	if parser.token.kind != tokenEnd {
+		return nil, parser.errorf(parser.token, "unexpected %s", parser.token)
+	}
+	return &Expr{source: source, root: root, used: parser.used}, nil
+}
+
+// Eval computes the expression, values holds the variables in the order given to Parse
+func (expr *Expr) Eval(values []float64) float64 {
+	return expr.root.eval(values)
+}
+
+func (expr *Expr) String() string {
+	return expr.source
+}
+
+// Uses tells whether the expression reads the variable name
+func (expr *Expr) Uses(name string) bool {
+	return expr.used[name]
+}
+
+type node interface {
+	eval(values []float64) float64
+}
+
+type numberNode float64
+
+func (n numberNode) eval(values []float64) float64 {
+	return float64(n)
+}
+
+type variableNode int
+
+func (n variableNode) eval(values []float64) float64 {
+	return values[n]
+}
+
+type unaryNode struct {
+	operand node
+}
+
+func (n *unaryNode) eval(values []float64) float64 {
+	return -n.operand.eval(values)
+}
+
+type binaryNode struct {
+	op          byte
+	left, right node
+}
+
+func (n *binaryNode) eval(values []float64) float64 {
+	left, right := n.left.eval(values), n.right.eval(values)
+	switch n.op {
+	case '+':
+		return left + right
+	case '-':
+		return left - right
+	case '*':
+		return left * right
+	default:
+		return left / right
+	}
+}
+
+type callNode struct {
+	fn   function
+	args []node
+}
+
+func (n *callNode) eval(values []float64) float64 {
+	args := make([]float64, len(n.args))
+	for index, arg := range n.args {
+		args[index] = arg.eval(values)
+	}
+	return n.fn.call(args)
+}
+
+type parser struct {
+	source    string
+	pos       int
+	token     token
+	variables map[string]int
+	used      map[string]bool
+}
+
+func (p *parser) errorf(at token, format string, args ...interface{}) error {
+	return &SyntaxError{Source: p.source, Column: at.pos + 1, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (p *parser) next() {
+	p.token, p.pos = scan(p.source, p.pos)
+}
+
+// expr := term (('+' | '-') term)*
+func (p *parser) parseExpr() (node, error) {
+	left, err := p.parseTerm()
+	if err != nil {
+		return nil, err
+	}
+	for p.token.kind == tokenOp && (p.token.text == "+" || p.token.text == "-") {
+		op := p.token.text[0]
+		p.next()
+		right, err := p.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryNode{op: op, left: left, right: right}
+	}
+	return left, nil
+}
+
+// term := unary (('*' | '/') unary)*
+func (p *parser) parseTerm() (node, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.token.kind == tokenOp && (p.token.text == "*" || p.token.text == "/") {
+		op := p.token.text[0]
+		p.next()
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryNode{op: op, left: left, right: right}
+	}
+	return left, nil
+}
+
+// unary := '-' unary | primary
+func (p *parser) parseUnary() (node, error) {
+	if p.token.kind == tokenOp && p.token.text == "-" {
+		p.next()
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &unaryNode{operand: operand}, nil
+	}
+	return p.parsePrimary()
+}
+
+// primary := number | variable | function '(' expr (',' expr)* ')' | '(' expr ')'
+func (p *parser) parsePrimary() (node, error) {
+	current := p.token
+	switch current.kind {
+	case tokenNumber:
+		p.next()
+		return numberNode(current.number), nil
+	case tokenIdent:
+		p.next()
+		if p.token.kind == tokenLParen {
+			return p.parseCall(current)
+		}
+		index, ok := p.variables[current.text]
+		if !ok {
+			return nil, p.errorf(current, "unknown variable %q, expect one of %s", current.text, p.knownVariables())
+		}
+		p.used[current.text] = true
+		return variableNode(index), nil
+	case tokenLParen:
+		p.next()
+		inner, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		if p.token.kind != tokenRParen {
+			return nil, p.errorf(p.token, "expect ) to close the ( at column %d, got %s", current.pos+1, p.token)
+		}
+		p.next()
+		return inner, nil
+	case tokenInvalid:
+		return nil, p.errorf(current, "cannot parse %q", current.text)
+	default:
+		return nil, p.errorf(current, "expect a number, variable or (, got %s", current)
+	}
+}
+
+func (p *parser) parseCall(name token) (node, error) {
+	fn, ok := FUNCTIONS[name.text]
+	if !ok {
+		return nil, p.errorf(name, "unknown function %q, expect one of %s", name.text, knownFunctions())
+	}
+	p.next()
+	call := &callNode{fn: fn}
+	for p.token.kind != tokenRParen {
+		if len(call.args) > 0 {
+			if p.token.kind != tokenComma {
+				return nil, p.errorf(p.token, "expect , or ) in the call of %s, got %s", name.text, p.token)
+			}
+			p.next()
+		}
+		arg, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		call.args = append(call.args, arg)
+	}
+	if len(call.args) != fn.arity {
+		return nil, p.errorf(name, "%s takes %d arguments, got %d", name.text, fn.arity, len(call.args))
+	}
+	p.next()
+	return call, nil
+}
+
+func (p *parser) knownVariables() string {
+	names := make([]string, 0, len(p.variables))
+	for name := range p.variables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+func knownFunctions() string {
+	names := make([]string, 0, len(FUNCTIONS))
+	for name := range FUNCTIONS {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
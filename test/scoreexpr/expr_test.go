@@ -0,0 +1,94 @@
+package scoreexpr
+
+import (
+	"errors"
+	"math"
+	"strings"
+	"testing"
+)
+
+var testVariables = []string{"PlayCnt", "Click", "Age"}
+
+func TestEval(t *testing.T) {
+	values := []float64{100, 7, 3600}
+	tests := []struct {
+		source string
+		want   float64
+	}{
+		{"1", 1},
+		{"Click", 7},
+		{"1 + 2 * 3", 7},
+		{"(1 + 2) * 3", 9},
+		{"10 - 4 - 3", 3},
+		{"8 / 4 / 2", 1},
+		{"-Click + 10", 3},
+		{"--2", 2},
+		{"2 * -3", -6},
+		{"1.5e2 + .5", 150.5},
+		{"log1p(PlayCnt - 99)", math.Log1p(1)},
+		{"max(Click, min(PlayCnt, 50))", 50},
+		{"pow(2, 10) + abs(-1)", 1025},
+		{"Click + 0.5*log1p(PlayCnt) - Age/3600", 7 + 0.5*math.Log1p(100) - 1},
+	}
+	for _, test := range tests {
+		expr, err := Parse(test.source, testVariables)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", test.source, err)
+			continue
+		}
+		if got := expr.Eval(values); math.Abs(got-test.want) > 1e-9 {
+			t.Errorf("Eval(%q) = %v, want %v", test.source, got, test.want)
+		}
+		if expr.String() != test.source {
+			t.Errorf("String() = %q, want %q", expr.String(), test.source)
+		}
+	}
+}
+
+func TestSyntaxError(t *testing.T) {
+	tests := []struct {
+		source string
+		column int
+		msg    string
+	}{
+		{"", 1, "empty expression"},
+		{"   ", 4, "empty expression"},
+		{"Clicks + 1", 1, `unknown variable "Clicks"`},
+		{"1 + Plays", 5, `unknown variable "Plays"`},
+		{"1 +", 4, "expect a number"},
+		{"(1 + 2", 7, "expect ) to close the ( at column 1"},
+		{"1 2", 3, `unexpected "2"`},
+		{"foo(1)", 1, `unknown function "foo"`},
+		{"log(1, 2)", 1, "log takes 1 arguments, got 2"},
+		{"max(1 2)", 7, "expect , or ) in the call of max"},
+		{"1 + $", 5, `cannot parse "$"`},
+		{"1.2.3", 1, `cannot parse "1.2.3"`},
+		{")", 1, "expect a number, variable or ("},
+	}
+	for _, test := range tests {
+		_, err := Parse(test.source, testVariables)
+		var syntaxErr *SyntaxError
+		if !errors.As(err, &syntaxErr) {
+			t.Errorf("Parse(%q) = %v, want a SyntaxError", test.source, err)
+			continue
+		}
+		if syntaxErr.Column != test.column || !strings.Contains(syntaxErr.Msg, test.msg) {
+			t.Errorf("Parse(%q): column %d %q, want column %d %q", test.source, syntaxErr.Column, syntaxErr.Msg, test.column, test.msg)
+		}
+		// the caret sits under the column
+		lines := strings.Split(err.Error(), "\n")
+		if caret := lines[len(lines)-1]; len(caret) != test.column+1 || !strings.HasSuffix(caret, "^") {
+			t.Errorf("Parse(%q): caret line %q for column %d", test.source, caret, test.column)
+		}
+	}
+}
+
+func TestUses(t *testing.T) {
+	expr, err := Parse("Click + max(PlayCnt, 1)", testVariables)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !expr.Uses("Click") || !expr.Uses("PlayCnt") || expr.Uses("Age") || expr.Uses("log1p") {
+		t.Errorf("Uses of %s: Click %v, PlayCnt %v, Age %v", expr, expr.Uses("Click"), expr.Uses("PlayCnt"), expr.Uses("Age"))
+	}
+}
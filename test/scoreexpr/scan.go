@@ -0,0 +1,94 @@
+package scoreexpr
+
+import (
+	"strconv"
+	"unicode/utf8"
+)
+
+type tokenKind int
+
+const (
+	tokenEnd tokenKind = iota
+	tokenNumber
+	tokenIdent
+	tokenOp
+	tokenLParen
+	tokenRParen
+	tokenComma
+	tokenInvalid
+)
+
+type token struct {
+	kind   tokenKind
+	text   string
+	number float64
+	pos    int
+}
+
+func (t token) String() string {
+	if t.kind == tokenEnd {
+		return "end of expression"
+	}
+	return strconv.Quote(t.text)
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// scan returns the token starting at pos, skipping spaces, and the position after it
+func scan(source string, pos int) (token, int) {
+	for pos < len(source) && (source[pos] == ' ' || source[pos] == '\t' || source[pos] == '\n' || source[pos] == '\r') {
+		pos++
+	}
+	if pos == len(source) {
+		return token{kind: tokenEnd, pos: pos}, pos
+	}
+	start := pos
+	c := source[pos]
+	switch {
+	case isDigit(c) || c == '.':
+		for pos < len(source) && (isDigit(source[pos]) || source[pos] == '.') {
+			pos++
+		}
+		// exponent such as 1e-3
+		if pos < len(source) && (source[pos] == 'e' || source[pos] == 'E') {
+			end := pos + 1
+			if end < len(source) && (source[end] == '+' || source[end] == '-') {
+				end++
+			}
+			if end < len(source) && isDigit(source[end]) {
+				for end < len(source) && isDigit(source[end]) {
+					end++
+				}
+				pos = end
+			}
+		}
+		text := source[start:pos]
+		number, err := strconv.ParseFloat(text, 64)
+		if err != nil {
+			return token{kind: tokenInvalid, text: text, pos: start}, pos
+		}
+		return token{kind: tokenNumber, text: text, number: number, pos: start}, pos
+	case isIdentStart(c):
+		for pos < len(source) && (isIdentStart(source[pos]) || isDigit(source[pos])) {
+			pos++
+		}
+		return token{kind: tokenIdent, text: source[start:pos], pos: start}, pos
+	case c == '+' || c == '-' || c == '*' || c == '/':
+		return token{kind: tokenOp, text: source[start : pos+1], pos: start}, pos + 1
+	case c == '(':
+		return token{kind: tokenLParen, text: "(", pos: start}, pos + 1
+	case c == ')':
+		return token{kind: tokenRParen, text: ")", pos: start}, pos + 1
+	case c == ',':
+		return token{kind: tokenComma, text: ",", pos: start}, pos + 1
+	default:
+		_, size := utf8.DecodeRuneInString(source[pos:])
+		return token{kind: tokenInvalid, text: source[start : pos+size], pos: start}, pos + size
+	}
+}
@@ -0,0 +1,125 @@
+// Package simhash fingerprints short texts such as video titles so that near
+// duplicates, e.g. re-uploads with an extra emoji or punctuation, get 64-bit
+// sums that differ in only a few bits.
+package simhash
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/bits"
+	"strings"
+	"unicode"
+)
+
+const (
+	SUM_BITS = 64
+	// a larger distance splits the sums into bands too narrow to narrow the search
+	MAX_DISTANCE = 16
+)
+
+// Sum returns the simhash of text over its letter and digit bigrams, case and
+// everything else are ignored; ok is false when text has no letter or digit
+func Sum(text string) (sum uint64, ok bool) {
+	var runes []rune
+	for _, r := range strings.ToLower(text) {
+		if unicode.IsLetter(r) || unicode.IsNumber(r) {
+			runes = append(runes, r)
+		}
+	}
+	if len(runes) == 0 {
+		return 0, false
+	}
+	var votes [SUM_BITS]int
+	addFeature := func(feature []rune) {
+		hasher := fnv.New64a()
+		hasher.Write([]byte(string(feature)))
+		featureHash := mix(hasher.Sum64())
+		for bit := 0; bit < SUM_BITS; bit++ {
+			if featureHash&(1<<uint(bit)) != 0 {
+				votes[bit]++
+			} else {
+				votes[bit]--
+			}
+		}
+	}
+	if len(runes) == 1 {
+		addFeature(runes)
+	}
+	for start := 0; start+2 <= len(runes); start++ {
+		addFeature(runes[start : start+2])
+	}
+	for bit := 0; bit < SUM_BITS; bit++ {
+		if votes[bit] > 0 {
+			sum |= 1 << uint(bit)
+		}
+	}
+	return sum, true
+}
+
+// finalizer of MurmurHash3, fnv alone leaves the high bits of two-rune features alike
+func mix(h uint64) uint64 {
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
+
+// Distance returns the number of bits a and b differ in
+func Distance(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
+
+// Index finds sums within a Hamming distance of the sums added so far. The sums
+// are cut into distance+1 bands, two sums within the distance agree on at least
+// one whole band, so only sums sharing a band are compared.
+type Index struct {
+	distance int
+	shifts   []uint
+	masks    []uint64
+	// one table per band, band value -> sums added with it
+	bands []map[uint64][]uint64
+}
+
+// NewIndex returns an empty index for distance in [0, MAX_DISTANCE]
+func NewIndex(distance int) (*Index, error) {
+	if distance < 0 || distance > MAX_DISTANCE {
+		return nil, fmt.Errorf("simhash distance must be in [0, %d], got %d", MAX_DISTANCE, distance)
+	}
+	count := distance + 1
+	index := &Index{distance: distance}
+	shift := uint(0)
+	for band := 0; band < count; band++ {
+		// spread the remainder bits over the first bands
+		width := uint(SUM_BITS / count)
+		if band < SUM_BITS%count {
+			width++
+		}
+		index.shifts = append(index.shifts, shift)
+		index.masks = append(index.masks, (uint64(1)<<width)-1)
+		index.bands = append(index.bands, make(map[uint64][]uint64, 0))
+		shift += width
+	}
+	return index, nil
+}
+
+// Near tells whether a sum within the distance of sum was added
+func (index *Index) Near(sum uint64) bool {
+	for band, table := range index.bands {
+		for _, candidate := range table[(sum>>index.shifts[band])&index.masks[band]] {
+			if Distance(sum, candidate) <= index.distance {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Add records sum
+func (index *Index) Add(sum uint64) {
+	for band, table := range index.bands {
+		key := (sum >> index.shifts[band]) & index.masks[band]
+		table[key] = append(table[key], sum)
+	}
+}
@@ -0,0 +1,95 @@
+package simhash
+
+import (
+	"testing"
+)
+
+func TestDistance(t *testing.T) {
+	tests := []struct {
+		a, b uint64
+		want int
+	}{
+		{0, 0, 0},
+		{0xFFFF, 0xFFFF, 0},
+		{0, 1, 1},
+		{1, 3, 1},
+		{0xF0, 0x0F, 8},
+		{0, ^uint64(0), SUM_BITS},
+		{1 << 63, 1, 2},
+	}
+	for _, test := range tests {
+		if got := Distance(test.a, test.b); got != test.want {
+			t.Errorf("Distance(%#x, %#x) = %d, want %d", test.a, test.b, got, test.want)
+		}
+		if got := Distance(test.b, test.a); got != test.want {
+			t.Errorf("Distance(%#x, %#x) = %d, want %d", test.b, test.a, got, test.want)
+		}
+	}
+}
+
+func TestSum(t *testing.T) {
+	const title = "the quick brown fox jumps over the lazy dog"
+	sum, ok := Sum(title)
+	if !ok {
+		t.Fatalf("Sum(%q) is not ok", title)
+	}
+	tests := []struct {
+		text string
+		// the distance to the sum of title lies in [min, max]
+		min, max int
+	}{
+		// case and punctuation are ignored
+		{"The Quick Brown Fox, jumps over the lazy dog!!", 0, 0},
+		{"the quick brown fox jumps over the lazy dog 2", 1, 6},
+		{"a completely different title about cooking", 17, SUM_BITS},
+	}
+	for _, test := range tests {
+		other, ok := Sum(test.text)
+		if !ok {
+			t.Fatalf("Sum(%q) is not ok", test.text)
+		}
+		if distance := Distance(sum, other); distance < test.min || distance > test.max {
+			t.Errorf("%q is %d bits from %q, want [%d, %d]", test.text, distance, title, test.min, test.max)
+		}
+	}
+	for _, text := range []string{"", " !? ", "—"} {
+		if _, ok := Sum(text); ok {
+			t.Errorf("Sum(%q) is ok without a letter or digit", text)
+		}
+	}
+}
+
+func TestIndex(t *testing.T) {
+	for _, distance := range []int{-1, MAX_DISTANCE + 1} {
+		if _, err := NewIndex(distance); err == nil {
+			t.Errorf("NewIndex(%d) accepted the distance", distance)
+		}
+	}
+	tests := []struct {
+		distance int
+		sum      uint64
+		want     bool
+	}{
+		{0, 0xABCD, true},
+		{0, 0xABCC, false},
+		{3, 0xABCD ^ 0x7, true},
+		{3, 0xABCD ^ 0xF, false},
+		// bits far apart fall into different bands
+		{3, 0xABCD ^ (1 | 1<<20 | 1<<63), true},
+		{MAX_DISTANCE, 0xABCD ^ 0xFFFF, true},
+		{MAX_DISTANCE, ^uint64(0xABCD), false},
+	}
+	for _, test := range tests {
+		index, err := NewIndex(test.distance)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if index.Near(test.sum) {
+			t.Errorf("distance %d: an empty index is near %#x", test.distance, test.sum)
+		}
+		index.Add(0xABCD)
+		if got := index.Near(test.sum); got != test.want {
+			t.Errorf("distance %d: Near(%#x) = %v, want %v", test.distance, test.sum, got, test.want)
+		}
+	}
+}
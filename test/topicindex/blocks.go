@@ -0,0 +1,222 @@
+package topicindex
+
+import (
+	"bytes"
+	"compress/flate"
+	"container/list"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+const (
+	// uncompressed bytes a writer puts in a block when Header.BlockSize is 0
+	DEFAULT_BLOCK_SIZE = 64 * 1024
+	MAX_BLOCK_SIZE     = 64 * 1024 * 1024
+	// decompressed blocks a Reader keeps when Options.BlockCacheSize is 0
+	DEFAULT_BLOCK_CACHE_SIZE = 16
+	// deflate cannot expand data more than about 1032 times, a larger raw_len is corrupt
+	MAX_DEFLATE_RATIO = 1032
+	BLOCK_ENTRY_SIZE  = UINT32_SIZE * 2
+)
+
+// one compressed block of the records
+type block struct {
+	// file offset of the compressed bytes
+	Offset  int64
+	CompLen uint32
+	// offset of the first record byte in the uncompressed records, see listEntry.Offset
+	Start  int64
+	RawLen uint32
+}
+
+// decompressed blocks, least recently used first out
+type blockCache struct {
+	mu       sync.Mutex
+	capacity int
+	order    *list.List
+	blocks   map[int]*list.Element
+}
+
+type cachedBlock struct {
+	index int
+	data  []byte
+}
+
+func newBlockCache(capacity int) *blockCache {
+	return &blockCache{capacity: capacity, order: list.New(), blocks: make(map[int]*list.Element, 0)}
+}
+
+func (cache *blockCache) get(index int) ([]byte, bool) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	element, ok := cache.blocks[index]
+	if !ok {
+		return nil, false
+	}
+	cache.order.MoveToBack(element)
+	return element.Value.(*cachedBlock).data, true
+}
+
+func (cache *blockCache) put(index int, data []byte) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if _, ok := cache.blocks[index]; ok || cache.capacity <= 0 {
+		return
+	}
+	cache.blocks[index] = cache.order.PushBack(&cachedBlock{index: index, data: data})
+	for cache.order.Len() > cache.capacity {
+		oldest := cache.order.Front()
+		cache.order.Remove(oldest)
+		delete(cache.blocks, oldest.Value.(*cachedBlock).index)
+	}
+}
+
+// compress the pending records into a block, blocks end on record boundaries so
+// a list is decompressed from a single block unless it is larger than BlockSize
+func (writer *Writer) flushBlock() error {
+	if writer.pending.Len() == 0 {
+		return nil
+	}
+	var compressed bytes.Buffer
+	if writer.flater == nil {
+		flater, err := flate.NewWriter(&compressed, flate.DefaultCompression)
+		if err != nil {
+			return err
+		}
+		writer.flater = flater
+	} else {
+		writer.flater.Reset(&compressed)
+	}
+	if _, err := writer.flater.Write(writer.pending.Bytes()); err != nil {
+		return fmt.Errorf("compress block error: %w", err)
+	}
+	if err := writer.flater.Close(); err != nil {
+		return fmt.Errorf("compress block error: %w", err)
+	}
+	if uint64(compressed.Len()) > uint64(^uint32(0)) || uint64(writer.pending.Len()) > uint64(^uint32(0)) {
+		return fmt.Errorf("block of %d bytes is too large", writer.pending.Len())
+	}
+	writer.blocks = append(writer.blocks, block{CompLen: uint32(compressed.Len()), RawLen: uint32(writer.pending.Len())})
+	writer.pending.Reset()
+	return writer.write(compressed.Bytes())
+}
+
+// block_size, block_count and the comp_len, raw_len of every block, see the package doc
+func encodeBlockIndex(header Header, blocks []block) []byte {
+	buf := make([]byte, UINT32_SIZE*2, uint64(UINT32_SIZE)*2+uint64(len(blocks))*uint64(BLOCK_ENTRY_SIZE))
+	header.Order.PutUint32(buf[0:4], header.BlockSize)
+	header.Order.PutUint32(buf[4:8], uint32(len(blocks)))
+	entry := make([]byte, BLOCK_ENTRY_SIZE)
+	for _, blockEle := range blocks {
+		header.Order.PutUint32(entry[0:4], blockEle.CompLen)
+		header.Order.PutUint32(entry[4:8], blockEle.RawLen)
+		buf = append(buf, entry...)
+	}
+	return buf
+}
+
+// read the block index between indexOffset and end, the blocks lie from bodyStart
+// up to indexOffset, returns the end of the uncompressed records
+func (reader *Reader) readBlockIndex(indexOffset, end int64) (int64, error) {
+	if indexOffset < reader.bodyStart || indexOffset > end || end-indexOffset < int64(UINT32_SIZE)*2 {
+		return 0, corruptError(indexOffset, "", "block index at %d out of range [%d, %d]", indexOffset, reader.bodyStart, end)
+	}
+	buf, err := reader.readAt(indexOffset, end-indexOffset, "")
+	if err != nil {
+		return 0, err
+	}
+	blockSize := reader.order.Uint32(buf[0:4])
+	count := int64(reader.order.Uint32(buf[4:8]))
+	if blockSize == 0 || blockSize > MAX_BLOCK_SIZE {
+		return 0, corruptError(indexOffset, "", "block size %d out of range [1, %d]", blockSize, MAX_BLOCK_SIZE)
+	}
+	if count*int64(BLOCK_ENTRY_SIZE) != int64(len(buf))-int64(UINT32_SIZE)*2 {
+		return 0, corruptError(indexOffset, "", "%d blocks do not fill the %d bytes of the block index", count, len(buf))
+	}
+	reader.header.BlockSize = blockSize
+	reader.blocks = make([]block, 0, count)
+	offset, start := reader.bodyStart, reader.bodyStart
+	for pos := int(UINT32_SIZE) * 2; pos < len(buf); pos += int(BLOCK_ENTRY_SIZE) {
+		blockEle := block{
+			Offset:  offset,
+			CompLen: reader.order.Uint32(buf[pos:]),
+			Start:   start,
+			RawLen:  reader.order.Uint32(buf[pos+int(UINT32_SIZE):]),
+		}
+		if blockEle.CompLen == 0 || blockEle.RawLen == 0 || uint64(blockEle.RawLen) > uint64(blockEle.CompLen)*MAX_DEFLATE_RATIO {
+			return 0, corruptError(indexOffset, "", "block %d has comp_len %d, raw_len %d", len(reader.blocks), blockEle.CompLen, blockEle.RawLen)
+		}
+		reader.blocks = append(reader.blocks, blockEle)
+		offset += int64(blockEle.CompLen)
+		start += int64(blockEle.RawLen)
+	}
+	if offset != indexOffset {
+		return 0, corruptError(indexOffset, "", "blocks end at %d, the block index starts at %d", offset, indexOffset)
+	}
+	reader.cache = newBlockCache(reader.opts.BlockCacheSize)
+	if reader.opts.BlockCacheSize == 0 {
+		reader.cache.capacity = DEFAULT_BLOCK_CACHE_SIZE
+	}
+	return start, nil
+}
+
+// read length bytes of the records at offset, decompressing only the blocks holding them
+func (reader *Reader) readRecords(offset, length int64, key string) ([]byte, error) {
+	if reader.blocks == nil {
+		return reader.readAt(offset, length, key)
+	}
+	if length == 0 {
+		return []byte{}, nil
+	}
+	index := sort.Search(len(reader.blocks), func(i int) bool {
+		return reader.blocks[i].Start+int64(reader.blocks[i].RawLen) > offset
+	})
+	var buf []byte
+	for length > 0 {
+		if index >= len(reader.blocks) {
+			return nil, truncatedError(offset, key, "records end before %d more bytes", length)
+		}
+		data, err := reader.loadBlock(index, key)
+		if err != nil {
+			return nil, err
+		}
+		from := offset - reader.blocks[index].Start
+		if from < 0 || from > int64(len(data)) {
+			return nil, corruptError(offset, key, "offset lies outside block %d", index)
+		}
+		// a list running past the block continues in the next one
+		to := from + length
+		if to > int64(len(data)) || to < from {
+			to = int64(len(data))
+		}
+		// the common case of a list inside one block shares the cached bytes
+		if buf == nil && to-from == length {
+			return data[from:to], nil
+		}
+		buf = append(buf, data[from:to]...)
+		length -= to - from
+		offset += to - from
+		index++
+	}
+	return buf, nil
+}
+
+func (reader *Reader) loadBlock(index int, key string) ([]byte, error) {
+	if data, ok := reader.cache.get(index); ok {
+		return data, nil
+	}
+	blockEle := reader.blocks[index]
+	inflater := flate.NewReader(io.NewSectionReader(reader.r, blockEle.Offset, int64(blockEle.CompLen)))
+	defer inflater.Close()
+	data := make([]byte, blockEle.RawLen)
+	if _, err := io.ReadFull(inflater, data); err != nil {
+		return nil, corruptError(blockEle.Offset, key, "decompress block %d: %v", index, err)
+	}
+	if n, err := inflater.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+		return nil, corruptError(blockEle.Offset, key, "block %d holds more than its raw_len %d", index, blockEle.RawLen)
+	}
+	reader.cache.put(index, data)
+	return data, nil
+}
@@ -0,0 +1,156 @@
+package topicindex
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+const (
+	// 255 bounds split the values into the 256 weights of a uint8
+	MAX_WEIGHT_BOUNDS = 255
+	MAX_FEATURE_LEN   = 4096
+)
+
+// WeightBuckets tells what the Weight of a DocItem means: the weight is the number
+// of Bounds not greater than the value of Feature, so weight w stands for values
+// in [Bounds[w-1], Bounds[w])
+type WeightBuckets struct {
+	// how the value was computed, e.g. the expression PlayCnt
+	Feature string
+	// strictly ascending, at most MAX_WEIGHT_BOUNDS
+	Bounds []float64
+}
+
+// LinearBuckets splits [min, max] into count buckets of the same width,
+// values below min get weight 0 and values above max the last weight
+func LinearBuckets(feature string, min, max float64, count int) (*WeightBuckets, error) {
+	if err := checkBucketRange(min, max, count); err != nil {
+		return nil, err
+	}
+	buckets := &WeightBuckets{Feature: feature, Bounds: make([]float64, 0, count-1)}
+	for index := 1; index < count; index++ {
+		buckets.Bounds = append(buckets.Bounds, min+(max-min)*float64(index)/float64(count))
+	}
+	return buckets, buckets.Validate()
+}
+
+// LogBuckets splits [min, max] into count buckets of the same width on a log scale, min must be positive
+func LogBuckets(feature string, min, max float64, count int) (*WeightBuckets, error) {
+	if err := checkBucketRange(min, max, count); err != nil {
+		return nil, err
+	}
+	if min <= 0 {
+		return nil, fmt.Errorf("log buckets need a positive min, got %v", min)
+	}
+	buckets := &WeightBuckets{Feature: feature, Bounds: make([]float64, 0, count-1)}
+	for index := 1; index < count; index++ {
+		buckets.Bounds = append(buckets.Bounds, min*math.Pow(max/min, float64(index)/float64(count)))
+	}
+	return buckets, buckets.Validate()
+}
+
+func checkBucketRange(min, max float64, count int) error {
+	if count < 2 || count > MAX_WEIGHT_BOUNDS+1 {
+		return fmt.Errorf("bucket count must be in [2, %d], got %d", MAX_WEIGHT_BOUNDS+1, count)
+	}
+	if math.IsNaN(min) || math.IsInf(min, 0) || math.IsNaN(max) || math.IsInf(max, 0) || !(max > min) {
+		return fmt.Errorf("bucket range [%v, %v] is empty or not finite", min, max)
+	}
+	return nil
+}
+
+// Validate reports buckets that cannot be stored or decoded
+func (buckets *WeightBuckets) Validate() error {
+	if buckets.Feature == "" || len(buckets.Feature) > MAX_FEATURE_LEN {
+		return fmt.Errorf("weight feature must have 1 to %d bytes, got %d", MAX_FEATURE_LEN, len(buckets.Feature))
+	}
+	if len(buckets.Bounds) == 0 || len(buckets.Bounds) > MAX_WEIGHT_BOUNDS {
+		return fmt.Errorf("weight buckets need 1 to %d bounds, got %d", MAX_WEIGHT_BOUNDS, len(buckets.Bounds))
+	}
+	for index, bound := range buckets.Bounds {
+		if math.IsNaN(bound) || math.IsInf(bound, 0) {
+			return fmt.Errorf("weight bound %d is %v", index, bound)
+		}
+		if index > 0 && !(buckets.Bounds[index-1] < bound) {
+			return fmt.Errorf("weight bounds are not strictly ascending at %d: %v, %v", index, buckets.Bounds[index-1], bound)
+		}
+	}
+	return nil
+}
+
+// Weight returns the bucket of value, NaN falls in bucket 0
+func (buckets *WeightBuckets) Weight(value float64) uint8 {
+	if math.IsNaN(value) {
+		return 0
+	}
+	return uint8(sort.Search(len(buckets.Bounds), func(i int) bool {
+		return buckets.Bounds[i] > value
+	}))
+}
+
+// Range decodes a weight into the values it stands for, [low, high)
+func (buckets *WeightBuckets) Range(weight uint8) (low, high float64) {
+	low, high = math.Inf(-1), math.Inf(1)
+	if weight > 0 && int(weight) <= len(buckets.Bounds) {
+		low = buckets.Bounds[weight-1]
+	}
+	if int(weight) < len(buckets.Bounds) {
+		high = buckets.Bounds[weight]
+	}
+	return low, high
+}
+
+// on-disk form of the header extension, see the package doc
+func encodeWeightBuckets(header Header) []byte {
+	buckets := header.WeightBuckets
+	buf := make([]byte, UINT32_SIZE, uint64(UINT32_SIZE)*2+uint64(len(buckets.Feature))+uint64(len(buckets.Bounds))*uint64(UINT64_SIZE))
+	header.Order.PutUint32(buf, uint32(len(buckets.Feature)))
+	buf = append(buf, buckets.Feature...)
+	item := make([]byte, UINT64_SIZE)
+	header.Order.PutUint32(item, uint32(len(buckets.Bounds)))
+	buf = append(buf, item[:UINT32_SIZE]...)
+	for _, bound := range buckets.Bounds {
+		header.Order.PutUint64(item, math.Float64bits(bound))
+		buf = append(buf, item...)
+	}
+	return buf
+}
+
+// read the weight buckets stored at offset, returns the offset after them
+func (reader *Reader) readWeightBuckets(offset int64) (int64, error) {
+	buf, err := reader.readAt(offset, int64(UINT32_SIZE), "")
+	if err != nil {
+		return 0, err
+	}
+	featureLen := int64(reader.order.Uint32(buf))
+	if featureLen == 0 || featureLen > MAX_FEATURE_LEN {
+		return 0, corruptError(offset, "", "weight feature_len %d out of range", featureLen)
+	}
+	feature, err := reader.readAt(offset+int64(UINT32_SIZE), featureLen, "")
+	if err != nil {
+		return 0, err
+	}
+	countOffset := offset + int64(UINT32_SIZE) + featureLen
+	buf, err = reader.readAt(countOffset, int64(UINT32_SIZE), "")
+	if err != nil {
+		return 0, err
+	}
+	count := int64(reader.order.Uint32(buf))
+	if count == 0 || count > MAX_WEIGHT_BOUNDS {
+		return 0, corruptError(countOffset, "", "weight bound count %d out of range", count)
+	}
+	buf, err = reader.readAt(countOffset+int64(UINT32_SIZE), count*int64(UINT64_SIZE), "")
+	if err != nil {
+		return 0, err
+	}
+	buckets := &WeightBuckets{Feature: string(feature), Bounds: make([]float64, 0, count)}
+	for start := 0; start < len(buf); start += int(UINT64_SIZE) {
+		buckets.Bounds = append(buckets.Bounds, math.Float64frombits(reader.order.Uint64(buf[start:])))
+	}
+	if err := buckets.Validate(); err != nil {
+		return 0, corruptError(offset, "", "%v", err)
+	}
+	reader.header.WeightBuckets = buckets
+	return countOffset + int64(UINT32_SIZE) + int64(len(buf)), nil
+}
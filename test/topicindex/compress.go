@@ -0,0 +1,117 @@
+package topicindex
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+// every compressed item takes at least a vid gap, a rank and a weight byte
+const MIN_COMPRESSED_ITEM_SIZE = 3
+
+// encodeList writes the list in the compressed form of the package doc: vids
+// sorted ascending as gaps, then the rank of each sorted vid, the weights in vid
+// order and, withSortVal, the sort values in rank order as signed differences
+func encodeList(DocItemList []*DocItem, withSortVal bool) []byte {
+	byVid := make([]int, len(DocItemList))
+	for rank := range byVid {
+		byVid[rank] = rank
+	}
+	sort.SliceStable(byVid, func(i, j int) bool {
+		return DocItemList[byVid[i]].Vid < DocItemList[byVid[j]].Vid
+	})
+
+	buf := make([]byte, 0, len(DocItemList)*(MIN_COMPRESSED_ITEM_SIZE+2))
+	varint := make([]byte, binary.MaxVarintLen64)
+	previous := uint64(0)
+	for _, rank := range byVid {
+		vid := DocItemList[rank].Vid
+		buf = append(buf, varint[:binary.PutUvarint(varint, vid-previous)]...)
+		previous = vid
+	}
+	for _, rank := range byVid {
+		buf = append(buf, varint[:binary.PutUvarint(varint, uint64(rank))]...)
+	}
+	for _, rank := range byVid {
+		buf = append(buf, DocItemList[rank].Weight)
+	}
+	if withSortVal {
+		previous = 0
+		for _, DocItemEle := range DocItemList {
+			// wraps around for differences beyond int64, decoding wraps back
+			buf = append(buf, varint[:binary.PutVarint(varint, int64(DocItemEle.SortVal-previous))]...)
+			previous = DocItemEle.SortVal
+		}
+	}
+	return buf
+}
+
+// decodeList reverses encodeList for a list of count items that fills buf exactly
+func decodeList(buf []byte, count int, withSortVal bool) ([]*DocItem, error) {
+	items := make([]DocItem, count)
+	vids := make([]uint64, count)
+	pos := 0
+	uvarint := func(what string, index int) (uint64, error) {
+		value, n := binary.Uvarint(buf[pos:])
+		if n <= 0 {
+			return 0, fmt.Errorf("bad %s varint of item %d at byte %d", what, index, pos)
+		}
+		pos += n
+		return value, nil
+	}
+
+	previous := uint64(0)
+	for index := range vids {
+		gap, err := uvarint("vid", index)
+		if err != nil {
+			return nil, err
+		}
+		if previous+gap < previous {
+			return nil, fmt.Errorf("vid of item %d overflows", index)
+		}
+		previous += gap
+		vids[index] = previous
+	}
+	ranks := make([]int, count)
+	seen := make([]bool, count)
+	for index := range ranks {
+		rank, err := uvarint("rank", index)
+		if err != nil {
+			return nil, err
+		}
+		if rank >= uint64(count) || seen[rank] {
+			return nil, fmt.Errorf("rank %d of item %d is out of range or repeated", rank, index)
+		}
+		seen[rank] = true
+		ranks[index] = int(rank)
+		items[rank].Vid = vids[index]
+	}
+	if len(buf)-pos < count {
+		return nil, fmt.Errorf("%d weights need %d bytes, %d left", count, count, len(buf)-pos)
+	}
+	for index, rank := range ranks {
+		items[rank].Weight = buf[pos+index]
+	}
+	pos += count
+	if withSortVal {
+		previous = 0
+		for rank := range items {
+			diff, n := binary.Varint(buf[pos:])
+			if n <= 0 {
+				return nil, fmt.Errorf("bad sort value varint of rank %d at byte %d", rank, pos)
+			}
+			pos += n
+			previous += uint64(diff)
+			items[rank].SortVal = previous
+		}
+	}
+	if pos != len(buf) {
+		return nil, fmt.Errorf("%d bytes left after %d items", len(buf)-pos, count)
+	}
+
+	DocItemList := make([]*DocItem, count)
+	for rank := range items {
+		DocItemList[rank] = &items[rank]
+	}
+	return DocItemList, nil
+}
@@ -0,0 +1,195 @@
+package topicindex
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+)
+
+// Index reads the posting lists of a dump, it is a Reader or an Overlay
+type Index interface {
+	Header() Header
+	Keys() []string
+	ListLen(key string) (int, error)
+	ListTotal(key string) (int, error)
+	Get(key string) ([]*DocItem, error)
+}
+
+func (delta *Delta) validate() error {
+	for index, key := range delta.Removed {
+		if key == "" {
+			return fmt.Errorf("empty removed key is not allowed")
+		}
+		if index > 0 && delta.Removed[index-1] >= key {
+			return fmt.Errorf("removed keys are not sorted and unique at %s", key)
+		}
+	}
+	return nil
+}
+
+// removes tells whether key is one of the sorted Removed keys
+func (delta *Delta) removes(key string) bool {
+	index := sort.SearchStrings(delta.Removed, key)
+	return index < len(delta.Removed) && delta.Removed[index] == key
+}
+
+// on-disk form of the delta section, see the package doc
+func encodeDelta(header Header) []byte {
+	delta := header.Delta
+	buf := make([]byte, UINT32_SIZE*2)
+	header.Order.PutUint32(buf[0:4], delta.BaseChecksum)
+	header.Order.PutUint32(buf[4:8], uint32(len(delta.Removed)))
+	keyLen := make([]byte, UINT32_SIZE)
+	for _, key := range delta.Removed {
+		header.Order.PutUint32(keyLen, uint32(len(key)))
+		buf = append(buf, keyLen...)
+		buf = append(buf, key...)
+	}
+	return buf
+}
+
+// read the delta section stored at offset, returns the offset after it
+func (reader *Reader) readDelta(offset int64) (int64, error) {
+	buf, err := reader.readAt(offset, int64(UINT32_SIZE)*2, "")
+	if err != nil {
+		return 0, err
+	}
+	delta := &Delta{BaseChecksum: reader.order.Uint32(buf[0:4])}
+	count := int64(reader.order.Uint32(buf[4:8]))
+	offset += int64(UINT32_SIZE) * 2
+	// every removed key takes at least 5 bytes, do not trust a count the file cannot hold
+	if count > (reader.size-offset)/int64(UINT32_SIZE+1) {
+		return 0, truncatedError(offset, "", "%d removed keys exceed the %d bytes left", count, reader.size-offset)
+	}
+	delta.Removed = make([]string, 0, count)
+	for index := int64(0); index < count; index++ {
+		keyOffset := offset
+		buf, err := reader.readAt(offset, int64(UINT32_SIZE), "")
+		if err != nil {
+			return 0, err
+		}
+		keyLen := int64(reader.order.Uint32(buf))
+		offset += int64(UINT32_SIZE)
+		if keyLen == 0 || keyLen > reader.size-offset {
+			return 0, corruptError(keyOffset, "", "removed key_len %d out of range", keyLen)
+		}
+		key, err := reader.readAt(offset, keyLen, "")
+		if err != nil {
+			return 0, err
+		}
+		offset += keyLen
+		delta.Removed = append(delta.Removed, string(key))
+	}
+	if err := delta.validate(); err != nil {
+		return 0, corruptError(offset, "", "%v", err)
+	}
+	reader.header.Delta = delta
+	return offset, nil
+}
+
+// Overlay reads a base dump with a delta dump applied: a key of the delta
+// replaces the key of the base, a removed key is gone and every other key
+// reads from the base. It does not own the readers, close them after use.
+type Overlay struct {
+	base   *Reader
+	delta  *Reader
+	header Header
+	// every key of the overlay, sorted
+	keys []string
+}
+
+// NewOverlay applies delta to base, delta must have been built against base
+func NewOverlay(base, delta *Reader) (*Overlay, error) {
+	baseHeader, deltaHeader := base.Header(), delta.Header()
+	if deltaHeader.Delta == nil {
+		return nil, fmt.Errorf("topicindex: overlay needs a delta dump, got a full dump")
+	}
+	if baseHeader.Delta != nil {
+		return nil, fmt.Errorf("topicindex: overlay base is a delta dump itself")
+	}
+	if baseHeader.Version < FORMAT_V2 || base.Checksum() != deltaHeader.Delta.BaseChecksum {
+		return nil, fmt.Errorf("topicindex: delta was built against the dump with crc %08x, the base has crc %08x",
+			deltaHeader.Delta.BaseChecksum, base.Checksum())
+	}
+	if baseHeader.HasSortVal() != deltaHeader.HasSortVal() {
+		return nil, fmt.Errorf("topicindex: base and delta disagree on FLAG_SORT_VAL")
+	}
+	if !reflect.DeepEqual(baseHeader.WeightBuckets, deltaHeader.WeightBuckets) {
+		return nil, fmt.Errorf("topicindex: base and delta use different weight buckets")
+	}
+
+	overlay := &Overlay{base: base, delta: delta}
+	baseKeys := base.Keys()
+	sort.Strings(baseKeys)
+	deltaKeys := delta.Keys()
+	sort.Strings(deltaKeys)
+	baseIndex, deltaIndex := 0, 0
+	for baseIndex < len(baseKeys) || deltaIndex < len(deltaKeys) {
+		if deltaIndex == len(deltaKeys) || (baseIndex < len(baseKeys) && baseKeys[baseIndex] < deltaKeys[deltaIndex]) {
+			if !deltaHeader.Delta.removes(baseKeys[baseIndex]) {
+				overlay.keys = append(overlay.keys, baseKeys[baseIndex])
+			}
+			baseIndex++
+			continue
+		}
+		if baseIndex < len(baseKeys) && baseKeys[baseIndex] == deltaKeys[deltaIndex] {
+			baseIndex++
+		}
+		overlay.keys = append(overlay.keys, deltaKeys[deltaIndex])
+		deltaIndex++
+	}
+
+	overlay.header = deltaHeader
+	overlay.header.Flags = (deltaHeader.Flags | baseHeader.Flags&FLAG_LIST_TOTAL) &^ FLAG_DELTA
+	overlay.header.Delta = nil
+	overlay.header.RecordCount = uint32(len(overlay.keys))
+	return overlay, nil
+}
+
+// Header returns the header of the delta as if it were a full dump
+func (overlay *Overlay) Header() Header {
+	return overlay.header
+}
+
+// Keys returns all keys of the overlay, sorted
+func (overlay *Overlay) Keys() []string {
+	return append([]string(nil), overlay.keys...)
+}
+
+// the reader holding key
+func (overlay *Overlay) source(key string) (*Reader, error) {
+	if _, err := overlay.delta.lookup(key); err == nil {
+		return overlay.delta, nil
+	}
+	if overlay.delta.header.Delta.removes(key) {
+		return nil, fmt.Errorf("topicindex: %w: %s", ErrNotFound, key)
+	}
+	return overlay.base, nil
+}
+
+// ListLen returns the number of DocItems stored under key
+func (overlay *Overlay) ListLen(key string) (int, error) {
+	reader, err := overlay.source(key)
+	if err != nil {
+		return 0, err
+	}
+	return reader.ListLen(key)
+}
+
+// ListTotal returns how many DocItems the list of key had before it was cut
+func (overlay *Overlay) ListTotal(key string) (int, error) {
+	reader, err := overlay.source(key)
+	if err != nil {
+		return 0, err
+	}
+	return reader.ListTotal(key)
+}
+
+// Get decodes the posting list stored under key
+func (overlay *Overlay) Get(key string) ([]*DocItem, error) {
+	reader, err := overlay.source(key)
+	if err != nil {
+		return nil, err
+	}
+	return reader.Get(key)
+}
@@ -0,0 +1,74 @@
+package topicindex
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func openTestDump(t *testing.T, buf []byte) *Reader {
+	t.Helper()
+	reader, err := NewReader(bytes.NewReader(buf), int64(len(buf)))
+	if err != nil {
+		t.Fatalf("NewReader: %v", err)
+	}
+	return reader
+}
+
+func TestOverlay(t *testing.T) {
+	header := Header{Order: INDEX_BYTE_ORDER, Flags: FLAG_SORT_VAL | FLAG_LIST_TOTAL}
+	records := testRecords(8, true, true)
+	baseBuf, _ := writeDump(t, header, records)
+	base := openTestDump(t, baseBuf)
+
+	// the delta changes the first record, adds one and removes the second
+	changed := testRecord{key: records[0].key, items: records[3].items, total: len(records[3].items)}
+	added := testRecord{key: TopicKey(1, NEW_SUFFIX), items: records[4].items, total: len(records[4].items)}
+	removed := records[1].key
+	deltaHeader := header
+	deltaHeader.Flags &^= FLAG_LIST_TOTAL
+	deltaHeader.Delta = &Delta{BaseChecksum: base.Checksum(), Removed: []string{removed}}
+	deltaBuf, _ := writeDump(t, deltaHeader, []testRecord{changed, added})
+	delta := openTestDump(t, deltaBuf)
+	if got := delta.Header().Delta; got == nil || got.BaseChecksum != base.Checksum() || len(got.Removed) != 1 || got.Removed[0] != removed {
+		t.Fatalf("delta section %+v", got)
+	}
+
+	overlay, err := NewOverlay(base, delta)
+	if err != nil {
+		t.Fatalf("NewOverlay: %v", err)
+	}
+	want := []testRecord{changed, added}
+	for _, record := range records[2:] {
+		want = append(want, record)
+	}
+	checkDump(t, overlay, want)
+	if _, err := overlay.Get(removed); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Get of a removed key: %v, want ErrNotFound", err)
+	}
+	if got := overlay.Header(); got.Delta != nil || got.Flags&FLAG_DELTA != 0 || !got.HasListTotal() || got.RecordCount != uint32(len(want)) {
+		t.Fatalf("overlay header %+v", got)
+	}
+
+	// a delta only applies to the dump it was built against
+	otherBuf, _ := writeDump(t, header, records[1:])
+	if _, err := NewOverlay(openTestDump(t, otherBuf), delta); err == nil || !strings.Contains(err.Error(), "crc") {
+		t.Fatalf("NewOverlay on another base: %v", err)
+	}
+	if _, err := NewOverlay(delta, delta); err == nil {
+		t.Fatal("NewOverlay accepted a delta as base")
+	}
+	if _, err := NewOverlay(base, base); err == nil {
+		t.Fatal("NewOverlay accepted a full dump as delta")
+	}
+}
+
+func TestDeltaValidate(t *testing.T) {
+	for _, removed := range [][]string{{""}, {"b", "a"}, {"a", "a"}} {
+		header := Header{Order: INDEX_BYTE_ORDER, Delta: &Delta{Removed: removed}}
+		if _, err := NewWriter(&bytes.Buffer{}, header); err == nil {
+			t.Errorf("removed keys %q were accepted", removed)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package topicindex
+
+import (
+	"sort"
+)
+
+// DiffOptions tune Diff
+type DiffOptions struct {
+	// only vids whose rank moved by more than RankThreshold positions are reported
+	RankThreshold int
+}
+
+// KeySummary names a key that only exists in one of the dumps
+type KeySummary struct {
+	Key   string `json:"key"`
+	Count int    `json:"count"`
+}
+
+// RankMove is a vid kept in a list at another position
+type RankMove struct {
+	Vid     uint64 `json:"vid"`
+	OldRank int    `json:"old_rank"`
+	NewRank int    `json:"new_rank"`
+}
+
+// ScoreChange is a vid kept in a list with another Weight or SortVal, the SortVals
+// are only compared when both dumps carry them
+type ScoreChange struct {
+	Vid        uint64 `json:"vid"`
+	OldWeight  uint8  `json:"old_weight"`
+	NewWeight  uint8  `json:"new_weight"`
+	OldSortVal uint64 `json:"old_sort_val"`
+	NewSortVal uint64 `json:"new_sort_val"`
+}
+
+// KeyDiff describes how the posting list of a key present in both dumps changed
+type KeyDiff struct {
+	Key      string        `json:"key"`
+	OldLen   int           `json:"old_len"`
+	NewLen   int           `json:"new_len"`
+	Entered  []uint64      `json:"entered,omitempty"`
+	Left     []uint64      `json:"left,omitempty"`
+	Moved    []RankMove    `json:"moved,omitempty"`
+	Rescored []ScoreChange `json:"rescored,omitempty"`
+}
+
+// DiffReport lists every key that differs between two dumps, keys are sorted
+type DiffReport struct {
+	Added     []KeySummary `json:"added"`
+	Removed   []KeySummary `json:"removed"`
+	Changed   []KeyDiff    `json:"changed"`
+	Unchanged int          `json:"unchanged"`
+}
+
+// Diff compares the dump oldReader against newReader key by key, either may be an Overlay
+func Diff(oldReader, newReader Index, opts DiffOptions) (*DiffReport, error) {
+	report := &DiffReport{Added: []KeySummary{}, Removed: []KeySummary{}, Changed: []KeyDiff{}}
+	oldKeys := sortedKeys(oldReader)
+	newKeys := sortedKeys(newReader)
+	compareSortVal := oldReader.Header().HasSortVal() && newReader.Header().HasSortVal()
+	oldIndex, newIndex := 0, 0
+	for oldIndex < len(oldKeys) || newIndex < len(newKeys) {
+		if newIndex == len(newKeys) || (oldIndex < len(oldKeys) && oldKeys[oldIndex] < newKeys[newIndex]) {
+			count, err := oldReader.ListLen(oldKeys[oldIndex])
+			if err != nil {
+				return nil, err
+			}
+			report.Removed = append(report.Removed, KeySummary{Key: oldKeys[oldIndex], Count: count})
+			oldIndex++
+			continue
+		}
+		if oldIndex == len(oldKeys) || newKeys[newIndex] < oldKeys[oldIndex] {
+			count, err := newReader.ListLen(newKeys[newIndex])
+			if err != nil {
+				return nil, err
+			}
+			report.Added = append(report.Added, KeySummary{Key: newKeys[newIndex], Count: count})
+			newIndex++
+			continue
+		}
+
+		key := oldKeys[oldIndex]
+		oldIndex++
+		newIndex++
+		oldList, err := oldReader.Get(key)
+		if err != nil {
+			return nil, err
+		}
+		newList, err := newReader.Get(key)
+		if err != nil {
+			return nil, err
+		}
+		if keyDiff, changed := diffList(key, oldList, newList, compareSortVal, opts); changed {
+			report.Changed = append(report.Changed, keyDiff)
+		} else {
+			report.Unchanged++
+		}
+	}
+	return report, nil
+}
+
+func sortedKeys(reader Index) []string {
+	keys := reader.Keys()
+	sort.Strings(keys)
+	return keys
+}
+
+// compare two posting lists by vid, changed is false when the vids are in the same
+// order with the same scores
+func diffList(key string, oldList, newList []*DocItem, compareSortVal bool, opts DiffOptions) (KeyDiff, bool) {
+	keyDiff := KeyDiff{Key: key, OldLen: len(oldList), NewLen: len(newList)}
+	changed := len(oldList) != len(newList)
+
+	oldRank := make(map[uint64]int, len(oldList))
+	for rank, DocItemEle := range oldList {
+		oldRank[DocItemEle.Vid] = rank
+	}
+	newRank := make(map[uint64]int, len(newList))
+	for rank, DocItemEle := range newList {
+		newRank[DocItemEle.Vid] = rank
+		if !changed && oldList[rank].Vid != DocItemEle.Vid {
+			changed = true
+		}
+	}
+
+	for rank, DocItemEle := range newList {
+		before, ok := oldRank[DocItemEle.Vid]
+		if !ok {
+			keyDiff.Entered = append(keyDiff.Entered, DocItemEle.Vid)
+			continue
+		}
+		if move := rank - before; move > opts.RankThreshold || -move > opts.RankThreshold {
+			keyDiff.Moved = append(keyDiff.Moved, RankMove{Vid: DocItemEle.Vid, OldRank: before, NewRank: rank})
+		}
+		oldItem := oldList[before]
+		if oldItem.Weight != DocItemEle.Weight || (compareSortVal && oldItem.SortVal != DocItemEle.SortVal) {
+			scoreChange := ScoreChange{Vid: DocItemEle.Vid, OldWeight: oldItem.Weight, NewWeight: DocItemEle.Weight}
+			if compareSortVal {
+				scoreChange.OldSortVal, scoreChange.NewSortVal = oldItem.SortVal, DocItemEle.SortVal
+			}
+			keyDiff.Rescored = append(keyDiff.Rescored, scoreChange)
+			changed = true
+		}
+	}
+	for _, DocItemEle := range oldList {
+		if _, ok := newRank[DocItemEle.Vid]; !ok {
+			keyDiff.Left = append(keyDiff.Left, DocItemEle.Vid)
+		}
+	}
+	return keyDiff, changed
+}
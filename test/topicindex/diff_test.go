@@ -0,0 +1,86 @@
+package topicindex
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	item := func(vid uint64, weight uint8, sortVal uint64) *DocItem {
+		return &DocItem{Vid: vid, Weight: weight, SortVal: sortVal}
+	}
+	oldRecords := []testRecord{
+		{key: "a", items: []*DocItem{item(1, 1, 10)}},
+		{key: "b", items: []*DocItem{item(1, 1, 10), item(2, 2, 20)}},
+		{key: "c", items: []*DocItem{item(1, 1, 10), item(2, 2, 20), item(3, 3, 30)}},
+		{key: "d", items: []*DocItem{item(1, 1, 10), item(2, 2, 20)}},
+		{key: "e", items: []*DocItem{item(1, 1, 10), item(2, 2, 20)}},
+	}
+	newRecords := []testRecord{
+		{key: "b", items: []*DocItem{item(1, 1, 10), item(2, 2, 20)}},
+		// reordered
+		{key: "c", items: []*DocItem{item(3, 3, 30), item(1, 1, 10), item(2, 2, 20)}},
+		// new weight
+		{key: "d", items: []*DocItem{item(1, 1, 10), item(2, 5, 20)}},
+		// new sort value
+		{key: "e", items: []*DocItem{item(1, 1, 10), item(2, 2, 25)}},
+		{key: "f", items: []*DocItem{item(4, 4, 40), item(5, 5, 50)}},
+	}
+	setTotals := func(records []testRecord) []testRecord {
+		for index := range records {
+			records[index].total = len(records[index].items)
+		}
+		return records
+	}
+	oldBuf, _ := writeDump(t, Header{Order: INDEX_BYTE_ORDER, Flags: FLAG_SORT_VAL}, setTotals(oldRecords))
+
+	tests := []struct {
+		name     string
+		newFlags uint32
+		changed  []string
+		rescored map[string][]ScoreChange
+	}{
+		{"sort_val", FLAG_SORT_VAL, []string{"c", "d", "e"}, map[string][]ScoreChange{
+			"d": {{Vid: 2, OldWeight: 2, NewWeight: 5, OldSortVal: 20, NewSortVal: 20}},
+			"e": {{Vid: 2, OldWeight: 2, NewWeight: 2, OldSortVal: 20, NewSortVal: 25}},
+		}},
+		// sort values are only compared when both dumps carry them
+		{"no sort_val in the new dump", 0, []string{"c", "d"}, map[string][]ScoreChange{
+			"d": {{Vid: 2, OldWeight: 2, NewWeight: 5}},
+		}},
+	}
+	for _, test := range tests {
+		newBuf, _ := writeDump(t, Header{Order: INDEX_BYTE_ORDER, Flags: test.newFlags}, setTotals(newRecords))
+		report, err := Diff(openTestDump(t, oldBuf), openTestDump(t, newBuf), DiffOptions{})
+		if err != nil {
+			t.Fatalf("%s: Diff: %v", test.name, err)
+		}
+		if want := []KeySummary{{Key: "f", Count: 2}}; !reflect.DeepEqual(report.Added, want) {
+			t.Errorf("%s: Added = %v, want %v", test.name, report.Added, want)
+		}
+		if want := []KeySummary{{Key: "a", Count: 1}}; !reflect.DeepEqual(report.Removed, want) {
+			t.Errorf("%s: Removed = %v, want %v", test.name, report.Removed, want)
+		}
+		// b, c, d and e are in both dumps
+		if want := 4 - len(test.changed); report.Unchanged != want {
+			t.Errorf("%s: Unchanged = %d, want %d", test.name, report.Unchanged, want)
+		}
+		var changed []string
+		for _, keyDiff := range report.Changed {
+			changed = append(changed, keyDiff.Key)
+			if !reflect.DeepEqual(keyDiff.Rescored, test.rescored[keyDiff.Key]) {
+				t.Errorf("%s: %s rescored %+v, want %+v", test.name, keyDiff.Key, keyDiff.Rescored, test.rescored[keyDiff.Key])
+			}
+			wantMoved := []RankMove(nil)
+			if keyDiff.Key == "c" {
+				wantMoved = []RankMove{{Vid: 3, OldRank: 2, NewRank: 0}, {Vid: 1, OldRank: 0, NewRank: 1}, {Vid: 2, OldRank: 1, NewRank: 2}}
+			}
+			if !reflect.DeepEqual(keyDiff.Moved, wantMoved) || keyDiff.Entered != nil || keyDiff.Left != nil {
+				t.Errorf("%s: %s moved %v, entered %v, left %v", test.name, keyDiff.Key, keyDiff.Moved, keyDiff.Entered, keyDiff.Left)
+			}
+		}
+		if !reflect.DeepEqual(changed, test.changed) {
+			t.Errorf("%s: changed keys %v, want %v", test.name, changed, test.changed)
+		}
+	}
+}
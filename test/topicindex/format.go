@@ -0,0 +1,261 @@
+// Package topicindex reads and writes the topic index files of DumpTopicIndex.
+//
+// A version 2 dump is laid out as
+//
+//	magic        [4]byte "TIDX"
+//	byte_order   uint16  0xFEFF, tells the byte order of every other integer
+//	version      uint16
+//	flags        uint32
+//	item_size    uint32  size of one DocItem on disk
+//	record_count uint32
+//	weight_buckets                        // only with FLAG_WEIGHT_BUCKETS
+//	delta                                 // only with FLAG_DELTA
+//	settings                              // only with FLAG_BUILD_SETTINGS
+//	records      [record_count]record     // in blocks with FLAG_BLOCK_COMPRESSED
+//	block_index                           // only with FLAG_BLOCK_COMPRESSED
+//	directory    [record_count]dir_entry  // only with FLAG_KEY_DIRECTORY
+//	block_index_offset uint64             // only with FLAG_BLOCK_COMPRESSED
+//	dir_offset   uint64                   // only with FLAG_KEY_DIRECTORY
+//	crc          uint32  CRC-32 (IEEE) of everything before it
+//
+// and each record is
+//
+//	key_len  uint32
+//	key      [key_len]byte
+//	list_len  uint32              // bytes, a multiple of item_size unless compressed
+//	item_count uint32             // only with FLAG_COMPRESSED_LISTS
+//	total_len uint32              // only with FLAG_LIST_TOTAL, items the list had
+//	                              // before it was cut, see Reader.ListTotal
+//	items     [list_len]byte      // vid uint64, weight uint8 per item
+//	                              // and sort_val uint64 with FLAG_SORT_VAL
+//
+// item_size always matches the flags, so a reader that only knows 9-byte
+// items rejects a dump carrying sort values instead of misreading it.
+//
+// With FLAG_COMPRESSED_LISTS item_size is the size of a decoded item and the
+// items of a list of n vids are stored as
+//
+//	vid_gaps   [n]uvarint  // the vids sorted ascending, each minus the one before
+//	ranks      [n]uvarint  // position of each sorted vid in the list
+//	weights    [n]uint8    // in sorted vid order
+//	sort_vals  [n]varint   // only with FLAG_SORT_VAL, in list order, each minus
+//	                       // the one before as a wrapping int64
+//
+// so the vids that share high bits take a byte or two and the list keeps its order.
+//
+// weight_buckets records what the Weight of every DocItem means, see WeightBuckets
+//
+//	feature_len  uint32
+//	feature      [feature_len]byte        // e.g. the expression log1p(PlayCnt)
+//	bound_count  uint32                   // 1 to MAX_WEIGHT_BOUNDS
+//	bounds       [bound_count]float64     // IEEE 754 bits, strictly ascending
+//
+// A delta dump holds only the records that changed since a base dump, see
+// Overlay, its delta section names the base and the keys the base loses
+//
+//	base_crc      uint32                  // crc of the base dump
+//	removed_count uint32
+//	removed       [removed_count]removed_key   // sorted, none of them is a record of the delta
+//
+// and each removed_key is key_len uint32 followed by the key.
+//
+// The settings section records how the lists were built, see Header.Settings
+//
+//	settings_len uint32                   // 1 to MAX_SETTINGS_LEN
+//	settings     [settings_len]byte       // utf-8
+//
+// With FLAG_BLOCK_COMPRESSED, which needs FLAG_KEY_DIRECTORY, the records are
+// cut at record boundaries into blocks of about block_size bytes, each stored as
+// raw DEFLATE (compress/flate) right after the other, and the block index is
+//
+//	block_size  uint32                    // the block size the writer aimed at
+//	block_count uint32
+//	blocks      [block_count]block_entry  // comp_len uint32, raw_len uint32
+//
+// The offsets of the directory then count the records uncompressed, from the
+// end of the header on, so a reader finds the block of a list by summing raw_len
+// and only decompresses that block. The crc covers the compressed file.
+//
+// The directory is sorted by key so a reader can binary-search a key and
+// read its items without scanning the records, each dir_entry is
+//
+//	key_len   uint32
+//	key       [key_len]byte
+//	offset    uint64   // file offset of the items of the record, see FLAG_BLOCK_COMPRESSED
+//	list_len  uint32
+//	item_count uint32  // only with FLAG_COMPRESSED_LISTS, same as in the record
+//	total_len uint32   // only with FLAG_LIST_TOTAL, same as in the record
+//
+// Writers always use INDEX_BYTE_ORDER, readers follow byte_order so dumps
+// stay readable on machines of either endianness.
+//
+// Version 1 dumps have no magic: they start with a bare uint32 item_size
+// followed by the records up to the end of the file, in the byte order of
+// the machine that built them, which the reader detects from item_size.
+package topicindex
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	UINT8_SIZE    = uint32(1)
+	UINT32_SIZE   = uint32(4)
+	UINT64_SIZE   = uint32(8)
+	DOC_ITEM_SIZE = UINT64_SIZE + UINT8_SIZE
+	// DocItem with its SortVal, written with FLAG_SORT_VAL
+	DOC_ITEM_SORT_SIZE = DOC_ITEM_SIZE + UINT64_SIZE
+
+	INDEX_MAGIC     = "TIDX"
+	BYTE_ORDER_MARK = uint16(0xFEFF)
+	FORMAT_V1       = uint16(1)
+	FORMAT_V2       = uint16(2)
+	HEADER_V2_SIZE  = uint32(4 + 2 + 2 + 4 + 4 + 4)
+	DIR_OFFSET_SIZE = UINT64_SIZE
+
+	// flags of the version 2 header
+	FLAG_KEY_DIRECTORY = uint32(1 << 0)
+	FLAG_SORT_VAL      = uint32(1 << 1)
+	// the header is followed by the weight buckets
+	FLAG_WEIGHT_BUCKETS = uint32(1 << 2)
+	// records and directory entries carry the length of the list before it was cut
+	FLAG_LIST_TOTAL = uint32(1 << 3)
+	// the dump is a delta on top of a base dump
+	FLAG_DELTA = uint32(1 << 4)
+	// the header records the settings of the build, see above
+	FLAG_BUILD_SETTINGS = uint32(1 << 5)
+	// the items of every list are delta varint coded, see above
+	FLAG_COMPRESSED_LISTS = uint32(1 << 6)
+	// the records are stored in flate blocks, see above
+	FLAG_BLOCK_COMPRESSED = uint32(1 << 7)
+	KNOWN_FLAGS           = FLAG_KEY_DIRECTORY | FLAG_SORT_VAL | FLAG_WEIGHT_BUCKETS | FLAG_LIST_TOTAL | FLAG_DELTA |
+		FLAG_BUILD_SETTINGS | FLAG_COMPRESSED_LISTS | FLAG_BLOCK_COMPRESSED
+
+	TOPIC_PREFIX  = "TOPIC_"
+	TOPIC_ALL_KEY = "TOPIC_ALL_8"
+	HOT_SUFFIX    = "_HOT_8"
+	NEW_SUFFIX    = "_NEW_8"
+	CTR_SUFFIX    = "_CTR_8"
+	TREND_SUFFIX  = "_TREND_8"
+)
+
+// INDEX_BYTE_ORDER is the byte order every dump is written in
+var INDEX_BYTE_ORDER binary.ByteOrder = binary.LittleEndian
+
+// Header describes the layout of a dump
+type Header struct {
+	Version     uint16
+	Order       binary.ByteOrder
+	Flags       uint32
+	ItemSize    uint32
+	RecordCount uint32
+	// set with FLAG_WEIGHT_BUCKETS, nil when weights have no recorded meaning
+	WeightBuckets *WeightBuckets
+	// set with FLAG_DELTA, nil for a full dump
+	Delta *Delta
+	// with FLAG_BLOCK_COMPRESSED the uncompressed bytes per block, a writer
+	// given a non-zero BlockSize sets the flag
+	BlockSize uint32
+	// set with FLAG_BUILD_SETTINGS, opaque to this package: the builder records
+	// what decides the lists besides the input data, empty when unknown
+	Settings string
+}
+
+// Delta tells which base dump a delta dump applies to and what the base loses
+type Delta struct {
+	// the checksum of the base dump, see Reader.Checksum
+	BaseChecksum uint32
+	// keys of the base that are gone, sorted
+	Removed []string
+}
+
+// HasSortVal tells whether the DocItems of the dump carry their SortVal
+func (header Header) HasSortVal() bool {
+	return header.Flags&FLAG_SORT_VAL != 0
+}
+
+// HasCompressedLists tells whether the items of the lists are compressed
+func (header Header) HasCompressedLists() bool {
+	return header.Flags&FLAG_COMPRESSED_LISTS != 0
+}
+
+// HasListTotal tells whether the records carry the length of their list before it was cut
+func (header Header) HasListTotal() bool {
+	return header.Flags&FLAG_LIST_TOTAL != 0
+}
+
+// ItemSizeOf returns the on-disk size of one DocItem for the header flags
+func ItemSizeOf(flags uint32) uint32 {
+	if flags&FLAG_SORT_VAL != 0 {
+		return DOC_ITEM_SORT_SIZE
+	}
+	return DOC_ITEM_SIZE
+}
+
+// DocItem is one entry of a posting list
+type DocItem struct {
+	Vid     uint64
+	Weight  uint8
+	SortVal uint64
+}
+
+var (
+	ErrTruncated = errors.New("truncated")
+	ErrCorrupt   = errors.New("corrupt")
+	ErrNotFound  = errors.New("key not found")
+	ErrChecksum  = errors.New("checksum mismatch")
+)
+
+// FormatError describes a dump that cannot be decoded, Err is ErrTruncated, ErrCorrupt or ErrChecksum
+type FormatError struct {
+	Offset int64
+	Key    string
+	Err    error
+	Reason string
+}
+
+func (e *FormatError) Error() string {
+	if e.Key != "" {
+		return fmt.Sprintf("topicindex: %v record at offset %d, key %s: %s", e.Err, e.Offset, e.Key, e.Reason)
+	}
+	return fmt.Sprintf("topicindex: %v record at offset %d: %s", e.Err, e.Offset, e.Reason)
+}
+
+func (e *FormatError) Unwrap() error {
+	return e.Err
+}
+
+func truncatedError(offset int64, key string, format string, args ...interface{}) error {
+	return &FormatError{Offset: offset, Key: key, Err: ErrTruncated, Reason: fmt.Sprintf(format, args...)}
+}
+
+func corruptError(offset int64, key string, format string, args ...interface{}) error {
+	return &FormatError{Offset: offset, Key: key, Err: ErrCorrupt, Reason: fmt.Sprintf(format, args...)}
+}
+
+// TopicKey returns the key of a topic list, e.g. TopicKey(12, HOT_SUFFIX) is TOPIC_12_HOT_8
+func TopicKey(topicId uint64, suffix string) string {
+	return TOPIC_PREFIX + strconv.FormatUint(topicId, 10) + suffix
+}
+
+// ParseTopicKey splits a key written by TopicKey into the topic id and the list suffix,
+// ok is false for TOPIC_ALL_8 and any key of another shape
+func ParseTopicKey(key string) (topicId uint64, suffix string, ok bool) {
+	if !strings.HasPrefix(key, TOPIC_PREFIX) {
+		return 0, "", false
+	}
+	rest := key[len(TOPIC_PREFIX):]
+	end := strings.IndexByte(rest, '_')
+	if end <= 0 {
+		return 0, "", false
+	}
+	topicId, err := strconv.ParseUint(rest[:end], 10, 64)
+	if err != nil {
+		return 0, "", false
+	}
+	return topicId, rest[end:], true
+}
@@ -0,0 +1,208 @@
+package topicindex
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+)
+
+// policies for a key found in more than one source of Merge
+const (
+	// the list of the last source holding the key is kept
+	MERGE_LAST_WINS = "last-wins"
+	// the vids of all lists are kept once, with the item of the last source
+	// holding the vid, and re-ranked by SortVal descending
+	MERGE_UNION = "union"
+	// Merge fails with ErrConflict
+	MERGE_ERROR = "error"
+)
+
+// ErrConflict is returned by Merge for a key held by several sources under MERGE_ERROR
+var ErrConflict = errors.New("duplicate key")
+
+// MERGE_OUTPUT_FLAGS are the flags MergeOptions may ask for
+const MERGE_OUTPUT_FLAGS = FLAG_COMPRESSED_LISTS | FLAG_BLOCK_COMPRESSED
+
+// MERGE_POLICIES are the policies Merge accepts
+var MERGE_POLICIES = []string{MERGE_LAST_WINS, MERGE_UNION, MERGE_ERROR}
+
+// MergeOptions tune Merge
+type MergeOptions struct {
+	// one of MERGE_POLICIES, TOPIC_ALL_8 is always merged as MERGE_UNION without
+	// re-ranking since every source lists its own topics in it
+	Policy string
+	// optional flags of the output such as FLAG_COMPRESSED_LISTS
+	Flags uint32
+	// uncompressed bytes per block of the output, non-zero sets FLAG_BLOCK_COMPRESSED
+	BlockSize uint32
+}
+
+// MergeStats count what Merge wrote
+type MergeStats struct {
+	Keys int
+	// keys held by more than one source
+	Conflicts int
+}
+
+// Merge writes the keys of all sources to w as one dump with a fresh key directory,
+// sources are full dumps with the same weight buckets, a delta must be applied with
+// an Overlay first. The output keeps SortVal and Settings only when every source has them,
+// and Settings only while MERGE_UNION joins no list but TOPIC_ALL_8.
+func Merge(w io.Writer, sources []Index, opts MergeOptions) (*MergeStats, error) {
+	known := false
+	for _, policy := range MERGE_POLICIES {
+		known = known || policy == opts.Policy
+	}
+	if !known {
+		return nil, fmt.Errorf("unknown merge policy %q", opts.Policy)
+	}
+	if len(sources) == 0 {
+		return nil, fmt.Errorf("nothing to merge")
+	}
+	if opts.Flags&^MERGE_OUTPUT_FLAGS != 0 {
+		return nil, fmt.Errorf("merge cannot set flags %#x", opts.Flags&^MERGE_OUTPUT_FLAGS)
+	}
+	header := Header{Order: INDEX_BYTE_ORDER, Flags: opts.Flags | FLAG_SORT_VAL, WeightBuckets: sources[0].Header().WeightBuckets,
+		BlockSize: opts.BlockSize, Settings: sources[0].Header().Settings}
+	// source indexes holding each key, in source order
+	holders := make(map[string][]int, 0)
+	for index, source := range sources {
+		sourceHeader := source.Header()
+		if sourceHeader.Delta != nil {
+			return nil, fmt.Errorf("source %d is a delta, overlay it on its base first", index)
+		}
+		if !reflect.DeepEqual(sourceHeader.WeightBuckets, header.WeightBuckets) {
+			return nil, fmt.Errorf("source %d has other weight buckets than source 0", index)
+		}
+		if !sourceHeader.HasSortVal() {
+			if opts.Policy == MERGE_UNION {
+				return nil, fmt.Errorf("source %d has no SortVal to re-rank by", index)
+			}
+			header.Flags &^= FLAG_SORT_VAL
+		}
+		// lists built with other settings make a dump no single build could have written
+		if sourceHeader.Settings != header.Settings {
+			header.Settings = ""
+		}
+		for _, key := range source.Keys() {
+			holders[key] = append(holders[key], index)
+		}
+	}
+	keys := make([]string, 0, len(holders))
+	for key := range holders {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	stats := &MergeStats{Keys: len(keys)}
+	for _, key := range keys {
+		if len(holders[key]) == 1 {
+			continue
+		}
+		stats.Conflicts++
+		if opts.Policy == MERGE_ERROR && key != TOPIC_ALL_KEY {
+			return nil, fmt.Errorf("topicindex: %w: %s in sources %v", ErrConflict, key, holders[key])
+		}
+		// a union may run past the cut the settings record
+		if opts.Policy == MERGE_UNION && key != TOPIC_ALL_KEY {
+			header.Settings = ""
+		}
+	}
+	// the record headers are written before the lists, so learn first whether any list is cut
+	for _, key := range keys {
+		for _, index := range holders[key] {
+			count, total, err := listSize(sources[index], key)
+			if err != nil {
+				return nil, err
+			}
+			if total > count {
+				header.Flags |= FLAG_LIST_TOTAL
+			}
+		}
+	}
+
+	header.RecordCount = uint32(len(keys))
+	writer, err := NewWriter(w, header)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		DocItemList, total, err := mergeList(sources, holders[key], key, opts.Policy)
+		if err != nil {
+			return nil, err
+		}
+		if err := writer.WriteRecordWithTotal([]byte(key), DocItemList, total); err != nil {
+			return nil, err
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+func listSize(source Index, key string) (count, total int, err error) {
+	if count, err = source.ListLen(key); err != nil {
+		return 0, 0, err
+	}
+	if total, err = source.ListTotal(key); err != nil {
+		return 0, 0, err
+	}
+	return count, total, nil
+}
+
+// the list of key merged from the sources at holders, total is at least its length
+func mergeList(sources []Index, holders []int, key string, policy string) ([]*DocItem, int, error) {
+	if key != TOPIC_ALL_KEY && policy != MERGE_UNION {
+		last := sources[holders[len(holders)-1]]
+		DocItemList, err := last.Get(key)
+		if err != nil {
+			return nil, 0, err
+		}
+		total, err := last.ListTotal(key)
+		if err != nil {
+			return nil, 0, err
+		}
+		if total < len(DocItemList) {
+			total = len(DocItemList)
+		}
+		return DocItemList, total, nil
+	}
+
+	var merged []*DocItem
+	positions := make(map[uint64]int, 0)
+	// the vids cut from a source are unknown, so the total is only a lower bound
+	total := 0
+	for _, index := range holders {
+		DocItemList, err := sources[index].Get(key)
+		if err != nil {
+			return nil, 0, err
+		}
+		sourceTotal, err := sources[index].ListTotal(key)
+		if err != nil {
+			return nil, 0, err
+		}
+		if sourceTotal > total {
+			total = sourceTotal
+		}
+		for _, DocItemEle := range DocItemList {
+			if position, ok := positions[DocItemEle.Vid]; ok {
+				merged[position] = DocItemEle
+				continue
+			}
+			positions[DocItemEle.Vid] = len(merged)
+			merged = append(merged, DocItemEle)
+		}
+	}
+	if key != TOPIC_ALL_KEY {
+		sort.SliceStable(merged, func(i, j int) bool {
+			return merged[i].SortVal > merged[j].SortVal
+		})
+	}
+	if total < len(merged) {
+		total = len(merged)
+	}
+	return merged, total, nil
+}
@@ -0,0 +1,96 @@
+package topicindex
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestMerge(t *testing.T) {
+	item := func(vid uint64, weight uint8, sortVal uint64) *DocItem {
+		return &DocItem{Vid: vid, Weight: weight, SortVal: sortVal}
+	}
+	const settings = `{"max_vids":2}`
+	source := func(records ...testRecord) *Reader {
+		for index := range records {
+			records[index].total = len(records[index].items)
+		}
+		buf, _ := writeDump(t, Header{Order: INDEX_BYTE_ORDER, Flags: FLAG_SORT_VAL, Settings: settings}, records)
+		return openTestDump(t, buf)
+	}
+	// TOPIC_ALL_8 lists the topics of each source
+	first := source(
+		testRecord{key: TOPIC_ALL_KEY, items: []*DocItem{item(1, 0, 11), item(2, 0, 12)}},
+		testRecord{key: "TOPIC_1_HOT_8", items: []*DocItem{item(10, 3, 30), item(11, 1, 10)}},
+		testRecord{key: "TOPIC_2_HOT_8", items: []*DocItem{item(20, 2, 20)}},
+	)
+	second := source(
+		testRecord{key: TOPIC_ALL_KEY, items: []*DocItem{item(3, 0, 13), item(1, 0, 21)}},
+		testRecord{key: "TOPIC_1_HOT_8", items: []*DocItem{item(12, 2, 20), item(11, 2, 15)}},
+		testRecord{key: "TOPIC_3_HOT_8", items: []*DocItem{item(30, 1, 5)}},
+	)
+	// only TOPIC_ALL_8 is shared with first
+	third := source(
+		testRecord{key: TOPIC_ALL_KEY, items: []*DocItem{item(4, 0, 14)}},
+		testRecord{key: "TOPIC_4_HOT_8", items: []*DocItem{item(40, 1, 40)}},
+	)
+	// never re-ranked, the item of the last source holding a topic wins
+	allOfFirstAndSecond := testRecord{key: TOPIC_ALL_KEY, items: []*DocItem{item(1, 0, 21), item(2, 0, 12), item(3, 0, 13)}}
+	untouched := []testRecord{
+		{key: "TOPIC_2_HOT_8", items: []*DocItem{item(20, 2, 20)}},
+		{key: "TOPIC_3_HOT_8", items: []*DocItem{item(30, 1, 5)}},
+	}
+
+	tests := []struct {
+		name      string
+		policy    string
+		sources   []Index
+		conflicts int
+		settings  string
+		records   []testRecord
+	}{
+		{"last wins", MERGE_LAST_WINS, []Index{first, second}, 2, settings, append([]testRecord{allOfFirstAndSecond,
+			{key: "TOPIC_1_HOT_8", items: []*DocItem{item(12, 2, 20), item(11, 2, 15)}}}, untouched...)},
+		// the union holds more vids than the settings allow, so they are dropped
+		{"union", MERGE_UNION, []Index{first, second}, 2, "", append([]testRecord{allOfFirstAndSecond,
+			{key: "TOPIC_1_HOT_8", items: []*DocItem{item(10, 3, 30), item(12, 2, 20), item(11, 2, 15)}}}, untouched...)},
+		// TOPIC_ALL_8 is the only shared key, merged as a union under every policy
+		{"error without conflicts", MERGE_ERROR, []Index{first, third}, 1, settings, []testRecord{
+			{key: TOPIC_ALL_KEY, items: []*DocItem{item(1, 0, 11), item(2, 0, 12), item(4, 0, 14)}},
+			{key: "TOPIC_1_HOT_8", items: []*DocItem{item(10, 3, 30), item(11, 1, 10)}},
+			{key: "TOPIC_2_HOT_8", items: []*DocItem{item(20, 2, 20)}},
+			{key: "TOPIC_4_HOT_8", items: []*DocItem{item(40, 1, 40)}},
+		}},
+		{"union without conflicts", MERGE_UNION, []Index{third, first}, 1, settings, []testRecord{
+			{key: TOPIC_ALL_KEY, items: []*DocItem{item(4, 0, 14), item(1, 0, 11), item(2, 0, 12)}},
+			{key: "TOPIC_1_HOT_8", items: []*DocItem{item(10, 3, 30), item(11, 1, 10)}},
+			{key: "TOPIC_2_HOT_8", items: []*DocItem{item(20, 2, 20)}},
+			{key: "TOPIC_4_HOT_8", items: []*DocItem{item(40, 1, 40)}},
+		}},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		stats, err := Merge(&buf, test.sources, MergeOptions{Policy: test.policy})
+		if err != nil {
+			t.Fatalf("%s: Merge: %v", test.name, err)
+		}
+		if stats.Keys != len(test.records) || stats.Conflicts != test.conflicts {
+			t.Errorf("%s: stats %+v, want %d keys and %d conflicts", test.name, stats, len(test.records), test.conflicts)
+		}
+		for index := range test.records {
+			test.records[index].total = len(test.records[index].items)
+		}
+		reader := openTestDump(t, buf.Bytes())
+		if got := reader.Header().Settings; got != test.settings {
+			t.Errorf("%s: settings %q, want %q", test.name, got, test.settings)
+		}
+		checkDump(t, reader, test.records)
+	}
+
+	if _, err := Merge(&bytes.Buffer{}, []Index{first, second}, MergeOptions{Policy: MERGE_ERROR}); !errors.Is(err, ErrConflict) {
+		t.Errorf("Merge with %s: %v, want ErrConflict", MERGE_ERROR, err)
+	}
+	if _, err := Merge(&bytes.Buffer{}, []Index{first}, MergeOptions{Policy: "first-wins"}); err == nil {
+		t.Errorf("Merge accepted an unknown policy")
+	}
+}
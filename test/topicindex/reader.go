@@ -0,0 +1,512 @@
+package topicindex
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+)
+
+// position of one posting list inside the file
+type listEntry struct {
+	Key    string
+	Offset int64
+	Count  uint32
+	// items before the list was cut, Count when the dump has no FLAG_LIST_TOTAL
+	Total uint32
+	// bytes of the items, Count times the item size unless the lists are compressed
+	Size uint32
+}
+
+// Options tune how a dump is opened
+type Options struct {
+	// SkipVerify skips the checksum pass over the whole file when opening,
+	// online readers of large dumps set it and call Verify when they need to
+	SkipVerify bool
+	// decompressed blocks kept of a FLAG_BLOCK_COMPRESSED dump,
+	// DEFAULT_BLOCK_CACHE_SIZE when 0, negative keeps none
+	BlockCacheSize int
+}
+
+// Reader gives random access to the posting lists of a dump
+type Reader struct {
+	r        io.ReaderAt
+	size     int64
+	closer   io.Closer
+	opts     Options
+	header   Header
+	order    binary.ByteOrder
+	itemSize uint32
+	// the records lie in [bodyStart, bodyEnd)
+	bodyStart int64
+	bodyEnd   int64
+	crcOffset int64
+	checksum  uint32
+	// entries are sorted by key when the dump has a key directory,
+	// otherwise they are in file order and index maps key to position
+	entries []listEntry
+	sorted  bool
+	index   map[string]int
+	// set with FLAG_BLOCK_COMPRESSED
+	blocks []block
+	cache  *blockCache
+}
+
+// Open opens the dump FileName and indexes its keys
+func Open(FileName string) (*Reader, error) {
+	return OpenWithOptions(FileName, Options{})
+}
+
+// OpenWithOptions is Open with explicit options
+func OpenWithOptions(FileName string, opts Options) (*Reader, error) {
+	fr, err := os.Open(FileName)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := fr.Stat()
+	if err != nil {
+		fr.Close()
+		return nil, err
+	}
+	reader, err := NewReaderWithOptions(fr, stat.Size(), opts)
+	if err != nil {
+		fr.Close()
+		return nil, fmt.Errorf("open index %s failed: %w", FileName, err)
+	}
+	reader.closer = fr
+	return reader, nil
+}
+
+// NewReader indexes the dump held by r, size is the total length of the dump in bytes.
+// Both version 2 dumps and the header-less version 1 dumps are accepted.
+func NewReader(r io.ReaderAt, size int64) (*Reader, error) {
+	return NewReaderWithOptions(r, size, Options{})
+}
+
+// NewReaderWithOptions is NewReader with explicit options
+func NewReaderWithOptions(r io.ReaderAt, size int64, opts Options) (*Reader, error) {
+	reader := &Reader{r: r, size: size, opts: opts, index: make(map[string]int, 0)}
+	buf, err := reader.readAt(0, int64(UINT32_SIZE), "")
+	if err != nil {
+		return nil, err
+	}
+	if string(buf) == INDEX_MAGIC {
+		err = reader.openV2()
+	} else {
+		err = reader.openV1(buf)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return reader, nil
+}
+
+func (reader *Reader) openV2() error {
+	buf, err := reader.readAt(0, int64(HEADER_V2_SIZE), "")
+	if err != nil {
+		return err
+	}
+	if buf[4] == 0xFE && buf[5] == 0xFF {
+		reader.order = binary.BigEndian
+	} else if buf[4] == 0xFF && buf[5] == 0xFE {
+		reader.order = binary.LittleEndian
+	} else {
+		return corruptError(4, "", "unknown byte order mark %x", buf[4:6])
+	}
+	header := Header{
+		Version:     reader.order.Uint16(buf[6:8]),
+		Order:       reader.order,
+		Flags:       reader.order.Uint32(buf[8:12]),
+		ItemSize:    reader.order.Uint32(buf[12:16]),
+		RecordCount: reader.order.Uint32(buf[16:20]),
+	}
+	if header.Version != FORMAT_V2 {
+		return corruptError(6, "", "unsupported format version %d", header.Version)
+	}
+	if header.Flags&^KNOWN_FLAGS != 0 {
+		return corruptError(8, "", "unsupported flags %#x", header.Flags&^KNOWN_FLAGS)
+	}
+	if expect := ItemSizeOf(header.Flags); header.ItemSize != expect {
+		return corruptError(12, "", "item size %d does not match flags %#x, expect %d", header.ItemSize, header.Flags, expect)
+	}
+	reader.header = header
+	reader.itemSize = header.ItemSize
+	reader.bodyStart = int64(HEADER_V2_SIZE)
+	if header.Flags&FLAG_WEIGHT_BUCKETS != 0 {
+		if reader.bodyStart, err = reader.readWeightBuckets(reader.bodyStart); err != nil {
+			return err
+		}
+	}
+	if header.Flags&FLAG_DELTA != 0 {
+		if reader.bodyStart, err = reader.readDelta(reader.bodyStart); err != nil {
+			return err
+		}
+	}
+	if header.Flags&FLAG_BUILD_SETTINGS != 0 {
+		if reader.bodyStart, err = reader.readSettings(reader.bodyStart); err != nil {
+			return err
+		}
+	}
+
+	reader.crcOffset = reader.size - int64(UINT32_SIZE)
+	if reader.crcOffset < reader.bodyStart {
+		return truncatedError(reader.bodyStart, "", "no room for the checksum")
+	}
+	reader.bodyEnd = reader.crcOffset
+	if buf, err = reader.readAt(reader.crcOffset, int64(UINT32_SIZE), ""); err != nil {
+		return err
+	}
+	reader.checksum = reader.order.Uint32(buf)
+	if header.Flags&FLAG_BLOCK_COMPRESSED != 0 && header.Flags&FLAG_KEY_DIRECTORY == 0 {
+		return corruptError(8, "", "FLAG_BLOCK_COMPRESSED needs FLAG_KEY_DIRECTORY")
+	}
+	if header.Flags&FLAG_KEY_DIRECTORY != 0 {
+		err = reader.readDirectory()
+	} else {
+		err = reader.scan(reader.bodyStart)
+	}
+	if err != nil {
+		return err
+	}
+	if uint32(len(reader.entries)) != header.RecordCount {
+		return truncatedError(reader.bodyEnd, "", "found %d records, header announced %d", len(reader.entries), header.RecordCount)
+	}
+	if reader.opts.SkipVerify {
+		return nil
+	}
+	return reader.Verify()
+}
+
+// load the sorted key directory instead of walking the records
+func (reader *Reader) readDirectory() error {
+	footerOffset := reader.crcOffset - int64(DIR_OFFSET_SIZE)
+	if footerOffset < reader.bodyStart {
+		return truncatedError(reader.bodyStart, "", "no room for the directory offset")
+	}
+	buf, err := reader.readAt(footerOffset, int64(DIR_OFFSET_SIZE), "")
+	if err != nil {
+		return err
+	}
+	dirOffset := reader.order.Uint64(buf)
+	if dirOffset < uint64(reader.bodyStart) || dirOffset > uint64(footerOffset) {
+		return corruptError(footerOffset, "", "directory offset %d out of range [%d, %d]", dirOffset, reader.bodyStart, footerOffset)
+	}
+	reader.bodyEnd = int64(dirOffset)
+	// the lists must lie in the records, which end at the directory unless they are compressed
+	recordsEnd := reader.bodyEnd
+	if reader.header.Flags&FLAG_BLOCK_COMPRESSED != 0 {
+		footerOffset -= int64(UINT64_SIZE)
+		if footerOffset < reader.bodyEnd {
+			return corruptError(footerOffset, "", "no room for the block index offset")
+		}
+		buf, err = reader.readAt(footerOffset, int64(UINT64_SIZE), "")
+		if err != nil {
+			return err
+		}
+		indexOffset := reader.order.Uint64(buf)
+		if indexOffset > uint64(reader.bodyEnd) {
+			return corruptError(footerOffset, "", "block index offset %d beyond the directory at %d", indexOffset, reader.bodyEnd)
+		}
+		if recordsEnd, err = reader.readBlockIndex(int64(indexOffset), reader.bodyEnd); err != nil {
+			return err
+		}
+	}
+	buf, err = reader.readAt(reader.bodyEnd, footerOffset-reader.bodyEnd, "")
+	if err != nil {
+		return err
+	}
+
+	entrySize := int(UINT64_SIZE + UINT32_SIZE)
+	if reader.header.HasCompressedLists() {
+		entrySize += int(UINT32_SIZE)
+	}
+	if reader.header.HasListTotal() {
+		entrySize += int(UINT32_SIZE)
+	}
+	// record_count is checked after the walk, do not trust it beyond what the directory can hold
+	capacity := len(buf) / (int(UINT32_SIZE) + 1 + entrySize)
+	if uint64(reader.header.RecordCount) < uint64(capacity) {
+		capacity = int(reader.header.RecordCount)
+	}
+	reader.entries = make([]listEntry, 0, capacity)
+	for pos := 0; pos < len(buf); {
+		entryOffset := reader.bodyEnd + int64(pos)
+		if len(buf)-pos < int(UINT32_SIZE) {
+			return corruptError(entryOffset, "", "directory entry cut short")
+		}
+		keyLen := int(reader.order.Uint32(buf[pos:]))
+		pos += int(UINT32_SIZE)
+		if keyLen == 0 || keyLen > len(buf)-pos-entrySize {
+			return corruptError(entryOffset, "", "directory key_len %d out of range", keyLen)
+		}
+		key := string(buf[pos : pos+keyLen])
+		pos += keyLen
+		offset := reader.order.Uint64(buf[pos:])
+		field := pos + int(UINT64_SIZE)
+		listLen := uint64(reader.order.Uint32(buf[field:]))
+		field += int(UINT32_SIZE)
+		count := uint32(listLen / uint64(reader.itemSize))
+		if reader.header.HasCompressedLists() {
+			count = reader.order.Uint32(buf[field:])
+			field += int(UINT32_SIZE)
+		}
+		total := count
+		if reader.header.HasListTotal() {
+			total = reader.order.Uint32(buf[field:])
+		}
+		pos += entrySize
+		if err := reader.checkListLen(listLen, count); err != nil {
+			return corruptError(entryOffset, key, "%v", err)
+		}
+		if total < count {
+			return corruptError(entryOffset, key, "total_len %d is below the %d items of the list", total, count)
+		}
+		if offset < uint64(reader.bodyStart) || offset > uint64(recordsEnd) || listLen > uint64(recordsEnd)-offset {
+			return corruptError(entryOffset, key, "list at offset %d, list_len %d lies outside the records", offset, listLen)
+		}
+		if count := len(reader.entries); count > 0 && reader.entries[count-1].Key >= key {
+			return corruptError(entryOffset, key, "directory is not sorted, previous key %s", reader.entries[count-1].Key)
+		}
+		reader.entries = append(reader.entries, listEntry{
+			Key: key, Offset: int64(offset), Count: count, Total: total, Size: uint32(listLen)})
+	}
+	reader.sorted = true
+	return nil
+}
+
+// Verify recomputes the checksum of a version 2 dump, version 1 dumps carry none
+func (reader *Reader) Verify() error {
+	if reader.header.Version < FORMAT_V2 {
+		return nil
+	}
+	crc := crc32.NewIEEE()
+	if _, err := io.Copy(crc, io.NewSectionReader(reader.r, 0, reader.crcOffset)); err != nil {
+		return fmt.Errorf("read index for checksum failed: %w", err)
+	}
+	if expect, got := reader.checksum, crc.Sum32(); expect != got {
+		return &FormatError{Offset: reader.crcOffset, Err: ErrChecksum,
+			Reason: fmt.Sprintf("stored crc %08x, computed %08x", expect, got)}
+	}
+	return nil
+}
+
+// the version 1 header is the bare DOC_ITEM_SIZE, it also tells the byte order of the file
+func (reader *Reader) openV1(buf []byte) error {
+	if binary.LittleEndian.Uint32(buf) == DOC_ITEM_SIZE {
+		reader.order = binary.LittleEndian
+	} else if binary.BigEndian.Uint32(buf) == DOC_ITEM_SIZE {
+		reader.order = binary.BigEndian
+	} else {
+		return corruptError(0, "", "unknown header %x, expect magic %s or DOC_ITEM_SIZE %d", buf, INDEX_MAGIC, DOC_ITEM_SIZE)
+	}
+	reader.itemSize = DOC_ITEM_SIZE
+	reader.bodyStart = int64(UINT32_SIZE)
+	reader.bodyEnd = reader.size
+	if err := reader.scan(reader.bodyStart); err != nil {
+		return err
+	}
+	reader.header = Header{
+		Version:     FORMAT_V1,
+		Order:       reader.order,
+		ItemSize:    reader.itemSize,
+		RecordCount: uint32(len(reader.entries)),
+	}
+	return nil
+}
+
+// walk key_len/key/list_len blocks from offset to the end of the body
+func (reader *Reader) scan(offset int64) error {
+	for offset < reader.bodyEnd {
+		recordOffset := offset
+		buf, err := reader.readAt(offset, int64(UINT32_SIZE), "")
+		if err != nil {
+			return err
+		}
+		keyLen := int64(reader.order.Uint32(buf))
+		offset += int64(UINT32_SIZE)
+		if keyLen == 0 {
+			return corruptError(recordOffset, "", "empty key")
+		}
+		if keyLen > reader.bodyEnd-offset {
+			return truncatedError(recordOffset, "", "key_len %d exceeds the %d bytes left", keyLen, reader.bodyEnd-offset)
+		}
+		keyBuf, err := reader.readAt(offset, keyLen, "")
+		if err != nil {
+			return err
+		}
+		key := string(keyBuf)
+		offset += keyLen
+
+		buf, err = reader.readAt(offset, int64(UINT32_SIZE), key)
+		if err != nil {
+			return err
+		}
+		listLen := int64(reader.order.Uint32(buf))
+		offset += int64(UINT32_SIZE)
+		count := uint32(listLen / int64(reader.itemSize))
+		if reader.header.HasCompressedLists() {
+			buf, err = reader.readAt(offset, int64(UINT32_SIZE), key)
+			if err != nil {
+				return err
+			}
+			count = reader.order.Uint32(buf)
+			offset += int64(UINT32_SIZE)
+		}
+		if err := reader.checkListLen(uint64(listLen), count); err != nil {
+			return corruptError(recordOffset, key, "%v", err)
+		}
+		total := count
+		if reader.header.HasListTotal() {
+			buf, err = reader.readAt(offset, int64(UINT32_SIZE), key)
+			if err != nil {
+				return err
+			}
+			total = reader.order.Uint32(buf)
+			offset += int64(UINT32_SIZE)
+			if total < count {
+				return corruptError(recordOffset, key, "total_len %d is below the %d items of the list", total, count)
+			}
+		}
+		if listLen > reader.bodyEnd-offset {
+			return truncatedError(recordOffset, key, "list_len %d exceeds the %d bytes left", listLen, reader.bodyEnd-offset)
+		}
+		if _, ok := reader.index[key]; ok {
+			return corruptError(recordOffset, key, "duplicate key")
+		}
+		reader.index[key] = len(reader.entries)
+		reader.entries = append(reader.entries, listEntry{
+			Key: key, Offset: offset, Count: count, Total: total, Size: uint32(listLen)})
+		offset += listLen
+	}
+	return nil
+}
+
+// a list of count items must fill list_len bytes, compressed items take at least MIN_COMPRESSED_ITEM_SIZE
+func (reader *Reader) checkListLen(listLen uint64, count uint32) error {
+	if reader.header.HasCompressedLists() {
+		if uint64(count)*MIN_COMPRESSED_ITEM_SIZE > listLen {
+			return fmt.Errorf("list_len %d is too short for %d compressed items", listLen, count)
+		}
+		return nil
+	}
+	if listLen%uint64(reader.itemSize) != 0 {
+		return fmt.Errorf("list_len %d is not a multiple of item size %d", listLen, reader.itemSize)
+	}
+	return nil
+}
+
+// read exactly length bytes at offset, a short read is reported as truncation
+func (reader *Reader) readAt(offset, length int64, key string) ([]byte, error) {
+	if offset+length > reader.size {
+		return nil, truncatedError(offset, key, "need %d bytes, only %d left", length, reader.size-offset)
+	}
+	buf := make([]byte, length)
+	if _, err := reader.r.ReadAt(buf, offset); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, truncatedError(offset, key, "need %d bytes: %v", length, err)
+		}
+		return nil, fmt.Errorf("read %d bytes at offset %d failed: %w", length, offset, err)
+	}
+	return buf, nil
+}
+
+// Header returns the header of the dump, for version 1 dumps it is derived from the content
+func (reader *Reader) Header() Header {
+	return reader.header
+}
+
+// Checksum returns the crc stored at the end of a version 2 dump, 0 for version 1,
+// a delta dump names its base by it
+func (reader *Reader) Checksum() uint32 {
+	return reader.checksum
+}
+
+// ByteOrder returns the byte order the dump was written in
+func (reader *Reader) ByteOrder() binary.ByteOrder {
+	return reader.order
+}
+
+// find the entry of key, by binary search when the dump has a key directory
+func (reader *Reader) lookup(key string) (listEntry, error) {
+	if reader.sorted {
+		index := sort.Search(len(reader.entries), func(i int) bool {
+			return reader.entries[i].Key >= key
+		})
+		if index < len(reader.entries) && reader.entries[index].Key == key {
+			return reader.entries[index], nil
+		}
+	} else if index, ok := reader.index[key]; ok {
+		return reader.entries[index], nil
+	}
+	return listEntry{}, fmt.Errorf("topicindex: %w: %s", ErrNotFound, key)
+}
+
+// Keys returns all keys, sorted when the dump has a key directory and in file order otherwise
+func (reader *Reader) Keys() []string {
+	keys := make([]string, 0, len(reader.entries))
+	for _, entry := range reader.entries {
+		keys = append(keys, entry.Key)
+	}
+	return keys
+}
+
+// ListLen returns the number of DocItems stored under key
+func (reader *Reader) ListLen(key string) (int, error) {
+	entry, err := reader.lookup(key)
+	if err != nil {
+		return 0, err
+	}
+	return int(entry.Count), nil
+}
+
+// ListTotal returns how many DocItems the list of key had before it was cut,
+// it is above ListLen only for a truncated list
+func (reader *Reader) ListTotal(key string) (int, error) {
+	entry, err := reader.lookup(key)
+	if err != nil {
+		return 0, err
+	}
+	return int(entry.Total), nil
+}
+
+// Get decodes the posting list stored under key
+func (reader *Reader) Get(key string) ([]*DocItem, error) {
+	entry, err := reader.lookup(key)
+	if err != nil {
+		return nil, err
+	}
+	buf, err := reader.readRecords(entry.Offset, int64(entry.Size), key)
+	if err != nil {
+		return nil, err
+	}
+	withSortVal := reader.header.HasSortVal()
+	if reader.header.HasCompressedLists() {
+		docList, err := decodeList(buf, int(entry.Count), withSortVal)
+		if err != nil {
+			return nil, corruptError(entry.Offset, key, "%v", err)
+		}
+		return docList, nil
+	}
+	docList := make([]*DocItem, 0, entry.Count)
+	for start := uint32(0); start < uint32(len(buf)); start += reader.itemSize {
+		docItem := &DocItem{
+			Vid:    reader.order.Uint64(buf[start : start+UINT64_SIZE]),
+			Weight: buf[start+UINT64_SIZE],
+		}
+		if withSortVal {
+			docItem.SortVal = reader.order.Uint64(buf[start+DOC_ITEM_SIZE : start+DOC_ITEM_SORT_SIZE])
+		}
+		docList = append(docList, docItem)
+	}
+	return docList, nil
+}
+
+// Close closes the underlying file when the Reader was created by Open
+func (reader *Reader) Close() error {
+	if reader.closer == nil {
+		return nil
+	}
+	return reader.closer.Close()
+}
@@ -0,0 +1,393 @@
+package topicindex
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+type testRecord struct {
+	key   string
+	items []*DocItem
+	total int
+}
+
+// records with empty, short and long lists, every third one cut when cut is set
+func testRecords(seed int64, withSortVal, cut bool) []testRecord {
+	rng := rand.New(rand.NewSource(seed))
+	var records []testRecord
+	for topic := 0; topic < 40; topic++ {
+		count := rng.Intn(60)
+		if topic%7 == 0 {
+			count = 0
+		}
+		record := testRecord{key: TopicKey(uint64(topic)*7919, HOT_SUFFIX)}
+		for index := 0; index < count; index++ {
+			item := &DocItem{Vid: uint64(rng.Int63n(1 << 40)), Weight: uint8(rng.Intn(256))}
+			if withSortVal {
+				item.SortVal = rng.Uint64()
+			}
+			record.items = append(record.items, item)
+		}
+		record.total = count
+		if cut && topic%3 == 0 {
+			record.total = count + 1 + rng.Intn(100)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func checkDump(t *testing.T, reader Index, records []testRecord) {
+	t.Helper()
+	var keys []string
+	for _, record := range records {
+		keys = append(keys, record.key)
+		DocItemList, err := reader.Get(record.key)
+		if err != nil {
+			t.Fatalf("Get %s: %v", record.key, err)
+		}
+		if len(DocItemList) != len(record.items) || (len(record.items) > 0 && !reflect.DeepEqual(DocItemList, record.items)) {
+			t.Fatalf("Get %s: got %d items, want %d", record.key, len(DocItemList), len(record.items))
+		}
+		if count, err := reader.ListLen(record.key); err != nil || count != len(record.items) {
+			t.Fatalf("ListLen %s = %d, %v, want %d", record.key, count, err, len(record.items))
+		}
+		if total, err := reader.ListTotal(record.key); err != nil || total != record.total {
+			t.Fatalf("ListTotal %s = %d, %v, want %d", record.key, total, err, record.total)
+		}
+	}
+	sort.Strings(keys)
+	got := reader.Keys()
+	sort.Strings(got)
+	if !reflect.DeepEqual(got, keys) {
+		t.Fatalf("Keys = %v, want %v", got, keys)
+	}
+	if _, err := reader.Get("TOPIC_MISSING"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Get of a missing key: %v, want ErrNotFound", err)
+	}
+}
+
+func writeDump(t *testing.T, header Header, records []testRecord) ([]byte, *Writer) {
+	t.Helper()
+	var buf bytes.Buffer
+	header.RecordCount = uint32(len(records))
+	writer, err := NewWriter(&buf, header)
+	if err != nil {
+		t.Fatalf("NewWriter: %v", err)
+	}
+	for _, record := range records {
+		if err := writer.WriteRecordWithTotal([]byte(record.key), record.items, record.total); err != nil {
+			t.Fatalf("WriteRecordWithTotal %s: %v", record.key, err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	return buf.Bytes(), writer
+}
+
+type layoutCase struct {
+	name   string
+	header Header
+}
+
+func layoutCases(t *testing.T) []layoutCase {
+	buckets, err := LinearBuckets("PlayCnt", 1, 100, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return []layoutCase{
+		{"plain", Header{}},
+		{"sort_val", Header{Flags: FLAG_SORT_VAL}},
+		{"weight_buckets", Header{Flags: FLAG_SORT_VAL, WeightBuckets: buckets}},
+		{"list_total", Header{Flags: FLAG_SORT_VAL | FLAG_LIST_TOTAL}},
+		{"settings", Header{Flags: FLAG_SORT_VAL, Settings: `{"min_vids":1}`}},
+		{"compressed_lists", Header{Flags: FLAG_COMPRESSED_LISTS}},
+		{"compressed_lists_sort_val", Header{Flags: FLAG_COMPRESSED_LISTS | FLAG_SORT_VAL}},
+		{"block_compressed", Header{Flags: FLAG_SORT_VAL, BlockSize: 256}},
+		{"everything", Header{Flags: FLAG_SORT_VAL | FLAG_LIST_TOTAL | FLAG_COMPRESSED_LISTS, WeightBuckets: buckets,
+			BlockSize: 100, Settings: `{"min_vids":1}`}},
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, layout := range layoutCases(t) {
+		for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+			header := layout.header
+			header.Order = order
+			records := testRecords(1, header.HasSortVal(), header.HasListTotal())
+			buf, writer := writeDump(t, header, records)
+			reader, err := NewReader(bytes.NewReader(buf), int64(len(buf)))
+			if err != nil {
+				t.Fatalf("%s %v: NewReader: %v", layout.name, order, err)
+			}
+			got := reader.Header()
+			if got.Version != FORMAT_V2 || got.Order != order || got.RecordCount != uint32(len(records)) {
+				t.Fatalf("%s %v: header %+v", layout.name, order, got)
+			}
+			if got.Flags != writer.Header().Flags || got.Flags&FLAG_KEY_DIRECTORY == 0 || got.ItemSize != ItemSizeOf(got.Flags) {
+				t.Fatalf("%s %v: flags %#x, item size %d", layout.name, order, got.Flags, got.ItemSize)
+			}
+			if !sort.StringsAreSorted(reader.Keys()) {
+				t.Fatalf("%s %v: keys are not sorted by the directory", layout.name, order)
+			}
+			if !reflect.DeepEqual(got.WeightBuckets, header.WeightBuckets) || got.Settings != header.Settings {
+				t.Fatalf("%s %v: weight buckets %v, settings %q", layout.name, order, got.WeightBuckets, got.Settings)
+			}
+			if (header.BlockSize != 0) != (got.Flags&FLAG_BLOCK_COMPRESSED != 0) || got.BlockSize != header.BlockSize {
+				t.Fatalf("%s %v: flags %#x, block size %d, want block size %d", layout.name, order, got.Flags, got.BlockSize, header.BlockSize)
+			}
+			if reader.Checksum() != writer.Checksum() {
+				t.Fatalf("%s %v: Checksum = %08x, the writer wrote %08x", layout.name, order, reader.Checksum(), writer.Checksum())
+			}
+			checkDump(t, reader, records)
+		}
+	}
+}
+
+func TestBlockCache(t *testing.T) {
+	records := testRecords(2, true, false)
+	buf, _ := writeDump(t, Header{Order: INDEX_BYTE_ORDER, Flags: FLAG_SORT_VAL, BlockSize: 1}, records)
+	for _, cacheSize := range []int{-1, 0, 3} {
+		reader, err := NewReaderWithOptions(bytes.NewReader(buf), int64(len(buf)), Options{BlockCacheSize: cacheSize})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// a block size of 1 puts every record in its own block
+		if len(reader.blocks) != len(records) {
+			t.Fatalf("%d blocks for %d records", len(reader.blocks), len(records))
+		}
+		checkDump(t, reader, records)
+		checkDump(t, reader, records)
+		limit := cacheSize
+		if cacheSize == 0 {
+			limit = DEFAULT_BLOCK_CACHE_SIZE
+		} else if cacheSize < 0 {
+			limit = 0
+		}
+		if cached := reader.cache.order.Len(); cached > limit {
+			t.Fatalf("BlockCacheSize %d keeps %d blocks", cacheSize, cached)
+		}
+	}
+}
+
+// hand-written version 1 dump: item_size, then key_len, key, list_len and items
+// the byte order mark tells the order of every other integer
+func TestByteOrderMark(t *testing.T) {
+	records := testRecords(2, true, false)
+	for _, test := range []struct {
+		order binary.ByteOrder
+		mark  []byte
+	}{
+		{INDEX_BYTE_ORDER, []byte{0xFF, 0xFE}},
+		{binary.BigEndian, []byte{0xFE, 0xFF}},
+	} {
+		buf, _ := writeDump(t, Header{Order: test.order, Flags: FLAG_SORT_VAL}, records)
+		if !bytes.Equal(buf[4:6], test.mark) {
+			t.Fatalf("%v: byte order mark %x, want %x", test.order, buf[4:6], test.mark)
+		}
+		reader, err := NewReader(bytes.NewReader(buf), int64(len(buf)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reader.ByteOrder() != test.order {
+			t.Fatalf("ByteOrder = %v, want %v", reader.ByteOrder(), test.order)
+		}
+	}
+}
+
+// hand-written version 1 dump: item_size, then key_len, key, list_len and items
+func encodeV1(order binary.ByteOrder, records []testRecord) []byte {
+	buf := make([]byte, 4)
+	order.PutUint32(buf, DOC_ITEM_SIZE)
+	field := make([]byte, 8)
+	for _, record := range records {
+		order.PutUint32(field, uint32(len(record.key)))
+		buf = append(buf, field[:4]...)
+		buf = append(buf, record.key...)
+		order.PutUint32(field, uint32(len(record.items))*DOC_ITEM_SIZE)
+		buf = append(buf, field[:4]...)
+		for _, item := range record.items {
+			order.PutUint64(field, item.Vid)
+			buf = append(buf, field...)
+			buf = append(buf, item.Weight)
+		}
+	}
+	return buf
+}
+
+func TestReadV1(t *testing.T) {
+	records := testRecords(3, false, false)
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		buf := encodeV1(order, records)
+		reader, err := NewReader(bytes.NewReader(buf), int64(len(buf)))
+		if err != nil {
+			t.Fatalf("%v: %v", order, err)
+		}
+		if header := reader.Header(); header.Version != FORMAT_V1 || header.Order != order || header.RecordCount != uint32(len(records)) {
+			t.Fatalf("%v: header %+v", order, header)
+		}
+		checkDump(t, reader, records)
+	}
+}
+
+func TestTruncatedV1(t *testing.T) {
+	records := testRecords(4, false, false)[:3]
+	buf := encodeV1(binary.LittleEndian, records)
+	// the record boundaries are the only clean ends
+	boundaries := map[int]bool{int(UINT32_SIZE): true}
+	for index := range records {
+		boundaries[len(encodeV1(binary.LittleEndian, records[:index+1]))] = true
+	}
+	for size := int(UINT32_SIZE); size < len(buf); size++ {
+		_, err := NewReader(bytes.NewReader(buf[:size]), int64(size))
+		if boundaries[size] {
+			if err != nil {
+				t.Fatalf("cut to %d bytes at a record boundary: %v", size, err)
+			}
+			continue
+		}
+		var formatErr *FormatError
+		if !errors.Is(err, ErrTruncated) || !errors.As(err, &formatErr) {
+			t.Fatalf("cut to %d of %d bytes: %v, want ErrTruncated", size, len(buf), err)
+		}
+	}
+}
+
+func TestCorruptV1(t *testing.T) {
+	order := binary.LittleEndian
+	records := testRecords(5, false, false)[1:3]
+	keyLen := int(UINT32_SIZE)
+	listLen := keyLen + int(UINT32_SIZE) + len(records[0].key)
+	tests := []struct {
+		name   string
+		modify func(buf []byte) []byte
+		want   error
+	}{
+		{"item size", func(buf []byte) []byte { order.PutUint32(buf, 17); return buf }, ErrCorrupt},
+		{"empty key", func(buf []byte) []byte { order.PutUint32(buf[keyLen:], 0); return buf }, ErrCorrupt},
+		{"huge key_len", func(buf []byte) []byte { order.PutUint32(buf[keyLen:], 0xFFFFFFFF); return buf }, ErrTruncated},
+		{"list_len", func(buf []byte) []byte { order.PutUint32(buf[listLen:], DOC_ITEM_SIZE+1); return buf }, ErrCorrupt},
+		{"huge list_len", func(buf []byte) []byte { order.PutUint32(buf[listLen:], DOC_ITEM_SIZE*0x0E38E38E); return buf }, ErrTruncated},
+		{"duplicate key", func(buf []byte) []byte {
+			return append(buf, encodeV1(order, records[:1])[UINT32_SIZE:]...)
+		}, ErrCorrupt},
+	}
+	for _, test := range tests {
+		bad := test.modify(encodeV1(order, records))
+		if _, err := NewReader(bytes.NewReader(bad), int64(len(bad))); !errors.Is(err, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.want)
+		}
+	}
+}
+
+func isFormatError(err error) bool {
+	return errors.Is(err, ErrTruncated) || errors.Is(err, ErrCorrupt) || errors.Is(err, ErrChecksum)
+}
+
+func TestTruncated(t *testing.T) {
+	for _, layout := range layoutCases(t) {
+		header := layout.header
+		header.Order = INDEX_BYTE_ORDER
+		buf, _ := writeDump(t, header, testRecords(4, header.HasSortVal(), header.HasListTotal()))
+		for size := 0; size < len(buf); size++ {
+			_, err := NewReaderWithOptions(bytes.NewReader(buf[:size]), int64(size), Options{SkipVerify: true})
+			if !isFormatError(err) {
+				t.Fatalf("%s cut to %d of %d bytes: %v", layout.name, size, len(buf), err)
+			}
+		}
+	}
+}
+
+func TestCorrupt(t *testing.T) {
+	order := INDEX_BYTE_ORDER
+	buf, _ := writeDump(t, Header{Order: order, Flags: FLAG_SORT_VAL}, testRecords(5, true, false))
+	dirOffset := len(buf) - int(UINT32_SIZE+DIR_OFFSET_SIZE)
+	tests := []struct {
+		name   string
+		modify func(buf []byte)
+		verify bool
+		want   error
+	}{
+		{"byte order mark", func(buf []byte) { buf[4] = 0 }, false, ErrCorrupt},
+		{"version", func(buf []byte) { order.PutUint16(buf[6:], 3) }, false, ErrCorrupt},
+		{"unknown flag", func(buf []byte) { order.PutUint32(buf[8:], FLAG_SORT_VAL|FLAG_KEY_DIRECTORY|1<<31) }, false, ErrCorrupt},
+		{"item size", func(buf []byte) { order.PutUint32(buf[12:], DOC_ITEM_SIZE) }, false, ErrCorrupt},
+		// the reader must not size anything by record_count before it is checked
+		{"record count", func(buf []byte) { order.PutUint32(buf[16:], 0xFFFFFF00) }, false, ErrTruncated},
+		{"directory offset", func(buf []byte) { order.PutUint64(buf[dirOffset:], uint64(len(buf))) }, false, ErrCorrupt},
+		{"directory key_len", func(buf []byte) {
+			start := int(order.Uint64(buf[dirOffset:]))
+			order.PutUint32(buf[start:], 0xFFFFFFFF)
+		}, false, ErrCorrupt},
+		{"checksum", func(buf []byte) { buf[len(buf)-1] ^= 0xFF }, true, ErrChecksum},
+		{"body byte", func(buf []byte) { buf[HEADER_V2_SIZE+2] ^= 0x01 }, true, ErrChecksum},
+	}
+	for _, test := range tests {
+		bad := append([]byte(nil), buf...)
+		test.modify(bad)
+		_, err := NewReaderWithOptions(bytes.NewReader(bad), int64(len(bad)), Options{SkipVerify: !test.verify})
+		if !errors.Is(err, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.want)
+		}
+	}
+
+	// a list offset near 2^64 must not wrap around the end of the records
+	for _, blockSize := range []uint32{0, 64} {
+		buf, _ := writeDump(t, Header{Order: order, Flags: FLAG_SORT_VAL, BlockSize: blockSize}, testRecords(5, true, false))
+		// the first directory entry with a non-empty list
+		field := int(order.Uint64(buf[len(buf)-int(UINT32_SIZE+DIR_OFFSET_SIZE):]))
+		var listLen uint64
+		for {
+			field += int(UINT32_SIZE) + int(order.Uint32(buf[field:]))
+			if listLen = uint64(order.Uint32(buf[field+int(UINT64_SIZE):])); listLen != 0 {
+				break
+			}
+			field += int(UINT64_SIZE + UINT32_SIZE)
+		}
+		// offset+list_len wraps to the start of the records
+		order.PutUint64(buf[field:], uint64(HEADER_V2_SIZE)-listLen)
+		_, err := NewReaderWithOptions(bytes.NewReader(buf), int64(len(buf)), Options{SkipVerify: true})
+		if !errors.Is(err, ErrCorrupt) {
+			t.Errorf("block size %d, wrapping list offset: got %v, want %v", blockSize, err, ErrCorrupt)
+		}
+	}
+}
+
+// flipped bytes must give errors, never a panic or a huge allocation
+func TestFlippedBytes(t *testing.T) {
+	rng := rand.New(rand.NewSource(6))
+	for _, layout := range layoutCases(t) {
+		header := layout.header
+		header.Order = INDEX_BYTE_ORDER
+		buf, _ := writeDump(t, header, testRecords(7, header.HasSortVal(), header.HasListTotal()))
+		for round := 0; round < 300; round++ {
+			bad := append([]byte(nil), buf...)
+			at := rng.Intn(len(bad))
+			bad[at] ^= byte(1 + rng.Intn(255))
+			name := fmt.Sprintf("%s byte %d", layout.name, at)
+			if _, err := NewReader(bytes.NewReader(bad), int64(len(bad))); err == nil {
+				t.Fatalf("%s: the checksum did not catch the flip", name)
+			}
+			reader, err := NewReaderWithOptions(bytes.NewReader(bad), int64(len(bad)), Options{SkipVerify: true})
+			if err != nil {
+				if !isFormatError(err) {
+					t.Fatalf("%s: %v", name, err)
+				}
+				continue
+			}
+			for _, key := range reader.Keys() {
+				if _, err := reader.Get(key); err != nil && !isFormatError(err) {
+					t.Fatalf("%s: Get %s: %v", name, key, err)
+				}
+				reader.ListLen(key)
+			}
+		}
+	}
+}
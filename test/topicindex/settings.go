@@ -0,0 +1,48 @@
+package topicindex
+
+import (
+	"fmt"
+	"unicode/utf8"
+)
+
+// longest settings a dump may record, see Header.Settings
+const MAX_SETTINGS_LEN = 1 << 20
+
+func validateSettings(settings string) error {
+	if len(settings) > MAX_SETTINGS_LEN {
+		return fmt.Errorf("settings of %d bytes exceed %d", len(settings), MAX_SETTINGS_LEN)
+	}
+	if !utf8.ValidString(settings) {
+		return fmt.Errorf("settings are not valid utf-8")
+	}
+	return nil
+}
+
+// on-disk form of the settings section, see the package doc
+func encodeSettings(header Header) []byte {
+	buf := make([]byte, UINT32_SIZE, int(UINT32_SIZE)+len(header.Settings))
+	header.Order.PutUint32(buf, uint32(len(header.Settings)))
+	return append(buf, header.Settings...)
+}
+
+// read the settings section stored at offset, returns the offset after it
+func (reader *Reader) readSettings(offset int64) (int64, error) {
+	buf, err := reader.readAt(offset, int64(UINT32_SIZE), "")
+	if err != nil {
+		return 0, err
+	}
+	settingsLen := int64(reader.order.Uint32(buf))
+	offset += int64(UINT32_SIZE)
+	if settingsLen == 0 || settingsLen > MAX_SETTINGS_LEN {
+		return 0, corruptError(offset-int64(UINT32_SIZE), "", "settings_len %d out of range [1, %d]", settingsLen, MAX_SETTINGS_LEN)
+	}
+	settings, err := reader.readAt(offset, settingsLen, "")
+	if err != nil {
+		return 0, err
+	}
+	if err := validateSettings(string(settings)); err != nil {
+		return 0, corruptError(offset, "", "%v", err)
+	}
+	reader.header.Settings = string(settings)
+	return offset + settingsLen, nil
+}
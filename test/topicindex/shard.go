@@ -0,0 +1,124 @@
+package topicindex
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+const (
+	// FNV-1a 64 of the decimal topic id, modulo the shard count
+	SHARD_HASH_FNV1A_64 = "fnv1a-64"
+	MAX_SHARDS          = 4096
+)
+
+// ShardOf returns the shard of topicId among count shards, count must be positive
+func ShardOf(topicId uint64, count int) int {
+	hasher := fnv.New64a()
+	hasher.Write([]byte(strconv.FormatUint(topicId, 10)))
+	return int(hasher.Sum64() % uint64(count))
+}
+
+// Manifest lists the shard files of a sharded dump. Every topic key is in the shard
+// ShardOf its topic id, TOPIC_ALL_8 is in every shard and lists all topics.
+type Manifest struct {
+	ShardCount int             `json:"shard_count"`
+	Hash       string          `json:"hash"`
+	Shards     []ManifestShard `json:"shards"`
+	// directory of the manifest, the shard files are relative to it
+	dir string
+}
+
+// ManifestShard is one shard file of a Manifest
+type ManifestShard struct {
+	File string `json:"file"`
+	// the trailing checksum of the shard, Reader.Checksum
+	Checksum uint32 `json:"crc32"`
+	Records  uint32 `json:"records"`
+	Size     int64  `json:"size"`
+}
+
+// Validate reports a manifest this package cannot route topics with
+func (manifest *Manifest) Validate() error {
+	if manifest.Hash != SHARD_HASH_FNV1A_64 {
+		return fmt.Errorf("unknown shard hash %q, expect %s", manifest.Hash, SHARD_HASH_FNV1A_64)
+	}
+	if manifest.ShardCount < 1 || manifest.ShardCount > MAX_SHARDS {
+		return fmt.Errorf("shard count must be in [1, %d], got %d", MAX_SHARDS, manifest.ShardCount)
+	}
+	if len(manifest.Shards) != manifest.ShardCount {
+		return fmt.Errorf("manifest lists %d shards, shard count is %d", len(manifest.Shards), manifest.ShardCount)
+	}
+	for index, shard := range manifest.Shards {
+		if shard.File == "" || filepath.IsAbs(shard.File) {
+			return fmt.Errorf("shard %d file %q must be relative to the manifest", index, shard.File)
+		}
+	}
+	return nil
+}
+
+// Shard returns the shard holding the lists of topicId
+func (manifest *Manifest) Shard(topicId uint64) int {
+	return ShardOf(topicId, manifest.ShardCount)
+}
+
+// ReadManifest reads and validates the manifest at FileName
+func ReadManifest(FileName string) (*Manifest, error) {
+	fr, err := os.Open(FileName)
+	if err != nil {
+		return nil, err
+	}
+	defer fr.Close()
+	manifest := &Manifest{}
+	decoder := json.NewDecoder(fr)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(manifest); err != nil {
+		return nil, fmt.Errorf("decode manifest %s error: %w", FileName, err)
+	}
+	if err := manifest.Validate(); err != nil {
+		return nil, fmt.Errorf("manifest %s: %w", FileName, err)
+	}
+	manifest.dir = filepath.Dir(FileName)
+	return manifest, nil
+}
+
+// WriteManifest writes manifest to FileName, the shard files must be relative to its directory
+func WriteManifest(FileName string, manifest *Manifest) (err error) {
+	if err := manifest.Validate(); err != nil {
+		return err
+	}
+	fw, err := os.Create(FileName)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := fw.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}()
+	encoder := json.NewEncoder(fw)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(manifest)
+}
+
+// OpenShard opens shard of a manifest read by ReadManifest and checks it is the file
+// the manifest was written for
+func (manifest *Manifest) OpenShard(shard int, opts Options) (*Reader, error) {
+	if shard < 0 || shard >= len(manifest.Shards) {
+		return nil, fmt.Errorf("shard %d out of range [0, %d)", shard, len(manifest.Shards))
+	}
+	entry := manifest.Shards[shard]
+	reader, err := OpenWithOptions(filepath.Join(manifest.dir, entry.File), opts)
+	if err != nil {
+		return nil, err
+	}
+	if reader.Checksum() != entry.Checksum {
+		reader.Close()
+		return nil, fmt.Errorf("topicindex: shard %d %s has crc %08x, the manifest expects %08x: %w",
+			shard, entry.File, reader.Checksum(), entry.Checksum, ErrChecksum)
+	}
+	return reader, nil
+}
@@ -0,0 +1,123 @@
+package topicindex
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestShardOf(t *testing.T) {
+	// shards are picked by readers built apart from the writer, they must never move
+	tests := []struct {
+		topicId uint64
+		// shard among 1, 8, 16 and MAX_SHARDS shards
+		want [4]int
+	}{
+		{0, [4]int{0, 7, 15, 3247}},
+		{1, [4]int{0, 4, 12, 2812}},
+		{42, [4]int{0, 3, 3, 547}},
+		{1000, [4]int{0, 4, 4, 2596}},
+		{123456789, [4]int{0, 4, 12, 3580}},
+		{^uint64(0), [4]int{0, 4, 4, 3156}},
+	}
+	for _, test := range tests {
+		for index, count := range []int{1, 8, 16, MAX_SHARDS} {
+			if got := ShardOf(test.topicId, count); got != test.want[index] {
+				t.Errorf("ShardOf(%d, %d) = %d, want %d", test.topicId, count, got, test.want[index])
+			}
+		}
+	}
+}
+
+func TestManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "manifest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	header := Header{Order: INDEX_BYTE_ORDER, Flags: FLAG_SORT_VAL}
+	manifest := &Manifest{ShardCount: 2, Hash: SHARD_HASH_FNV1A_64}
+	for shard := 0; shard < manifest.ShardCount; shard++ {
+		records := testRecords(int64(shard), true, false)
+		buf, writer := writeDump(t, header, records)
+		entry := ManifestShard{File: filepath.Join("shards", fmt.Sprintf("shard_%d", shard)), Checksum: writer.Checksum(),
+			Records: uint32(len(records)), Size: int64(len(buf))}
+		if err := os.MkdirAll(filepath.Join(dir, "shards"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, entry.File), buf, 0644); err != nil {
+			t.Fatal(err)
+		}
+		manifest.Shards = append(manifest.Shards, entry)
+	}
+	fileName := filepath.Join(dir, "manifest.json")
+	if err := WriteManifest(fileName, manifest); err != nil {
+		t.Fatalf("WriteManifest: %v", err)
+	}
+	read, err := ReadManifest(fileName)
+	if err != nil {
+		t.Fatalf("ReadManifest: %v", err)
+	}
+	for shard := range read.Shards {
+		reader, err := read.OpenShard(shard, Options{})
+		if err != nil {
+			t.Fatalf("OpenShard %d: %v", shard, err)
+		}
+		checkDump(t, reader, testRecords(int64(shard), true, false))
+		reader.Close()
+	}
+	if _, err := read.OpenShard(read.ShardCount, Options{}); err == nil {
+		t.Errorf("OpenShard accepted shard %d of %d", read.ShardCount, read.ShardCount)
+	}
+
+	// a wrong checksum, and shard files swapped after the manifest was written
+	wrong := *read
+	wrong.Shards = append([]ManifestShard(nil), read.Shards...)
+	wrong.Shards[0].Checksum ^= 1
+	if _, err := wrong.OpenShard(0, Options{}); !errors.Is(err, ErrChecksum) {
+		t.Errorf("OpenShard with a wrong checksum: %v, want ErrChecksum", err)
+	}
+	swapped := *read
+	swapped.Shards = append([]ManifestShard(nil), read.Shards...)
+	swapped.Shards[0].File, swapped.Shards[1].File = read.Shards[1].File, read.Shards[0].File
+	for shard := range swapped.Shards {
+		if _, err := swapped.OpenShard(shard, Options{}); !errors.Is(err, ErrChecksum) {
+			t.Errorf("OpenShard %d of a swapped file: %v, want ErrChecksum", shard, err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		change func(*Manifest)
+	}{
+		{"more shards than listed", func(manifest *Manifest) { manifest.ShardCount = 3 }},
+		{"fewer shards than listed", func(manifest *Manifest) { manifest.ShardCount = 1 }},
+		{"no shards", func(manifest *Manifest) { manifest.ShardCount, manifest.Shards = 0, nil }},
+		{"too many shards", func(manifest *Manifest) { manifest.ShardCount = MAX_SHARDS + 1 }},
+		{"unknown hash", func(manifest *Manifest) { manifest.Hash = "crc32" }},
+		{"absolute file", func(manifest *Manifest) { manifest.Shards[0].File = filepath.Join(dir, "shards", "shard_0") }},
+	}
+	for _, test := range tests {
+		changed := *manifest
+		changed.Shards = append([]ManifestShard(nil), manifest.Shards...)
+		test.change(&changed)
+		if err := WriteManifest(fileName, &changed); err == nil {
+			t.Errorf("%s: WriteManifest accepted the manifest", test.name)
+		}
+		// as written by another tool
+		buf, err := json.Marshal(&changed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(fileName, buf, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ReadManifest(fileName); err == nil {
+			t.Errorf("%s: ReadManifest accepted the manifest", test.name)
+		}
+	}
+}
@@ -0,0 +1,292 @@
+package topicindex
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"sort"
+)
+
+// Writer writes a version 2 dump, the records must be announced up front in the header
+type Writer struct {
+	w       *bufio.Writer
+	crc     hash.Hash32
+	header  Header
+	records uint32
+	// offset of the next record as the directory counts it, see FLAG_BLOCK_COMPRESSED
+	offset int64
+	// bytes written to the file
+	written   int64
+	directory []listEntry
+	// the trailing checksum, set by Close
+	checksum uint32
+	// with FLAG_BLOCK_COMPRESSED the records of the unfinished block and the finished blocks
+	pending          bytes.Buffer
+	flater           *flate.Writer
+	blocks           []block
+	blockIndexOffset int64
+}
+
+// NewWriter writes the header of a dump to w, the caller fills Order, RecordCount,
+// the optional flags such as FLAG_SORT_VAL, WeightBuckets, Settings and BlockSize, the rest is derived
+func NewWriter(w io.Writer, header Header) (*Writer, error) {
+	if header.Order == nil {
+		return nil, fmt.Errorf("index byte order is not set")
+	}
+	if header.Flags&^KNOWN_FLAGS != 0 {
+		return nil, fmt.Errorf("unsupported flags %#x", header.Flags&^KNOWN_FLAGS)
+	}
+	if header.Flags&FLAG_WEIGHT_BUCKETS != 0 && header.WeightBuckets == nil {
+		return nil, fmt.Errorf("FLAG_WEIGHT_BUCKETS is set without weight buckets")
+	}
+	if header.Flags&FLAG_DELTA != 0 && header.Delta == nil {
+		return nil, fmt.Errorf("FLAG_DELTA is set without a delta")
+	}
+	if header.Flags&FLAG_BUILD_SETTINGS != 0 && header.Settings == "" {
+		return nil, fmt.Errorf("FLAG_BUILD_SETTINGS is set without settings")
+	}
+	if header.Flags&FLAG_BLOCK_COMPRESSED != 0 && header.BlockSize == 0 {
+		header.BlockSize = DEFAULT_BLOCK_SIZE
+	}
+	if header.BlockSize > MAX_BLOCK_SIZE {
+		return nil, fmt.Errorf("block size %d exceeds %d", header.BlockSize, MAX_BLOCK_SIZE)
+	}
+	if header.BlockSize != 0 {
+		header.Flags |= FLAG_BLOCK_COMPRESSED
+	}
+	header.Version = FORMAT_V2
+	header.Flags |= FLAG_KEY_DIRECTORY
+	if header.WeightBuckets != nil {
+		if err := header.WeightBuckets.Validate(); err != nil {
+			return nil, err
+		}
+		header.Flags |= FLAG_WEIGHT_BUCKETS
+	}
+	if header.Delta != nil {
+		if err := header.Delta.validate(); err != nil {
+			return nil, err
+		}
+		header.Flags |= FLAG_DELTA
+	}
+	if header.Settings != "" {
+		if err := validateSettings(header.Settings); err != nil {
+			return nil, err
+		}
+		header.Flags |= FLAG_BUILD_SETTINGS
+	}
+	header.ItemSize = ItemSizeOf(header.Flags)
+
+	crc := crc32.NewIEEE()
+	writer := &Writer{
+		w:      bufio.NewWriter(io.MultiWriter(w, crc)),
+		crc:    crc,
+		header: header,
+	}
+	buf := EncodeHeader(writer.header)
+	if writer.header.WeightBuckets != nil {
+		buf = append(buf, encodeWeightBuckets(writer.header)...)
+	}
+	if writer.header.Delta != nil {
+		buf = append(buf, encodeDelta(writer.header)...)
+	}
+	if writer.header.Settings != "" {
+		buf = append(buf, encodeSettings(writer.header)...)
+	}
+	if err := writer.write(buf); err != nil {
+		return nil, fmt.Errorf("write index header error: %w", err)
+	}
+	writer.offset = int64(len(buf))
+	return writer, nil
+}
+
+// EncodeHeader returns the on-disk form of the fixed part of a version 2 header
+func EncodeHeader(header Header) []byte {
+	buf := make([]byte, HEADER_V2_SIZE)
+	copy(buf[0:4], INDEX_MAGIC)
+	header.Order.PutUint16(buf[4:6], BYTE_ORDER_MARK)
+	header.Order.PutUint16(buf[6:8], header.Version)
+	header.Order.PutUint32(buf[8:12], header.Flags)
+	header.Order.PutUint32(buf[12:16], header.ItemSize)
+	header.Order.PutUint32(buf[16:20], header.RecordCount)
+	return buf
+}
+
+// Header returns the header written at the start of the dump
+func (writer *Writer) Header() Header {
+	return writer.header
+}
+
+// WriteRecord appends the posting list of key
+func (writer *Writer) WriteRecord(key []byte, DocItemList []*DocItem) error {
+	return writer.WriteRecordWithTotal(key, DocItemList, len(DocItemList))
+}
+
+// WriteRecordWithTotal appends the posting list of key that was cut from a list of
+// total items, a total other than len(DocItemList) needs FLAG_LIST_TOTAL
+func (writer *Writer) WriteRecordWithTotal(key []byte, DocItemList []*DocItem, total int) error {
+	if writer.records >= writer.header.RecordCount {
+		return fmt.Errorf("record %s exceeds the announced record count %d", key, writer.header.RecordCount)
+	}
+	if len(key) == 0 {
+		return fmt.Errorf("empty key is not allowed")
+	}
+	if total < len(DocItemList) || uint64(total) > uint64(^uint32(0)) {
+		return fmt.Errorf("record %s has total %d out of range for %d items", key, total, len(DocItemList))
+	}
+	if total != len(DocItemList) && !writer.header.HasListTotal() {
+		return fmt.Errorf("record %s was cut from %d items, the header needs FLAG_LIST_TOTAL", key, total)
+	}
+	order := writer.header.Order
+	var items []byte
+	if writer.header.HasCompressedLists() {
+		items = encodeList(DocItemList, writer.header.HasSortVal())
+	} else {
+		items = writer.encodeItems(DocItemList)
+	}
+	listLen := uint64(len(items))
+	if uint64(len(key)) > uint64(^uint32(0)) || listLen > uint64(^uint32(0)) {
+		return fmt.Errorf("record %s is too large, key_len %d, list_len %d", key, len(key), listLen)
+	}
+
+	buf := make([]byte, UINT32_SIZE, uint64(UINT32_SIZE)*4+uint64(len(key))+listLen)
+	order.PutUint32(buf, uint32(len(key)))
+	buf = append(buf, key...)
+	buf = append(buf, make([]byte, UINT32_SIZE)...)
+	order.PutUint32(buf[len(buf)-int(UINT32_SIZE):], uint32(listLen))
+	if writer.header.HasCompressedLists() {
+		buf = append(buf, make([]byte, UINT32_SIZE)...)
+		order.PutUint32(buf[len(buf)-int(UINT32_SIZE):], uint32(len(DocItemList)))
+	}
+	if writer.header.HasListTotal() {
+		buf = append(buf, make([]byte, UINT32_SIZE)...)
+		order.PutUint32(buf[len(buf)-int(UINT32_SIZE):], uint32(total))
+	}
+	buf = append(buf, items...)
+	if writer.header.Flags&FLAG_BLOCK_COMPRESSED != 0 {
+		writer.pending.Write(buf)
+		if writer.pending.Len() >= int(writer.header.BlockSize) {
+			if err := writer.flushBlock(); err != nil {
+				return fmt.Errorf("write record %s error: %w", key, err)
+			}
+		}
+	} else if err := writer.write(buf); err != nil {
+		return fmt.Errorf("write record %s error: %w", key, err)
+	}
+	writer.records++
+	writer.directory = append(writer.directory, listEntry{
+		Key:    string(key),
+		Offset: writer.offset + int64(len(buf)) - int64(listLen),
+		Count:  uint32(len(DocItemList)),
+		Total:  uint32(total),
+		Size:   uint32(listLen),
+	})
+	writer.offset += int64(len(buf))
+	return nil
+}
+
+// the items of a list in the fixed item_size form
+func (writer *Writer) encodeItems(DocItemList []*DocItem) []byte {
+	order := writer.header.Order
+	buf := make([]byte, 0, uint64(len(DocItemList))*uint64(writer.header.ItemSize))
+	item := make([]byte, writer.header.ItemSize)
+	for _, DocItemEle := range DocItemList {
+		order.PutUint64(item[0:UINT64_SIZE], DocItemEle.Vid)
+		item[UINT64_SIZE] = DocItemEle.Weight
+		if writer.header.HasSortVal() {
+			order.PutUint64(item[DOC_ITEM_SIZE:DOC_ITEM_SORT_SIZE], DocItemEle.SortVal)
+		}
+		buf = append(buf, item...)
+	}
+	return buf
+}
+
+// write buf to the file, written counts the bytes that reached it
+func (writer *Writer) write(buf []byte) error {
+	n, err := writer.w.Write(buf)
+	writer.written += int64(n)
+	return err
+}
+
+// write the key directory sorted by key, followed by its offset
+func (writer *Writer) writeDirectory() error {
+	sort.Slice(writer.directory, func(i, j int) bool {
+		return writer.directory[i].Key < writer.directory[j].Key
+	})
+	order := writer.header.Order
+	dirOffset := writer.written
+	for index, entry := range writer.directory {
+		if index > 0 && writer.directory[index-1].Key == entry.Key {
+			return fmt.Errorf("duplicate key %s", entry.Key)
+		}
+		if writer.header.Delta != nil && writer.header.Delta.removes(entry.Key) {
+			return fmt.Errorf("key %s is both a record and removed by the delta", entry.Key)
+		}
+		buf := make([]byte, UINT32_SIZE, uint64(UINT32_SIZE)*3+uint64(UINT64_SIZE)+uint64(len(entry.Key)))
+		order.PutUint32(buf, uint32(len(entry.Key)))
+		buf = append(buf, entry.Key...)
+		buf = append(buf, make([]byte, UINT64_SIZE+UINT32_SIZE)...)
+		order.PutUint64(buf[len(buf)-int(UINT64_SIZE+UINT32_SIZE):], uint64(entry.Offset))
+		order.PutUint32(buf[len(buf)-int(UINT32_SIZE):], entry.Size)
+		if writer.header.HasCompressedLists() {
+			buf = append(buf, make([]byte, UINT32_SIZE)...)
+			order.PutUint32(buf[len(buf)-int(UINT32_SIZE):], entry.Count)
+		}
+		if writer.header.HasListTotal() {
+			buf = append(buf, make([]byte, UINT32_SIZE)...)
+			order.PutUint32(buf[len(buf)-int(UINT32_SIZE):], entry.Total)
+		}
+		if err := writer.write(buf); err != nil {
+			return fmt.Errorf("write directory entry %s error: %w", entry.Key, err)
+		}
+	}
+	var buf []byte
+	if writer.header.Flags&FLAG_BLOCK_COMPRESSED != 0 {
+		buf = make([]byte, UINT64_SIZE)
+		order.PutUint64(buf, uint64(writer.blockIndexOffset))
+	}
+	buf = append(buf, make([]byte, DIR_OFFSET_SIZE)...)
+	order.PutUint64(buf[len(buf)-int(DIR_OFFSET_SIZE):], uint64(dirOffset))
+	if err := writer.write(buf); err != nil {
+		return fmt.Errorf("write directory offset error: %w", err)
+	}
+	return nil
+}
+
+// Close writes the key directory and the trailing checksum and flushes,
+// it does not close the underlying writer
+func (writer *Writer) Close() error {
+	if writer.records != writer.header.RecordCount {
+		return fmt.Errorf("wrote %d records, header announced %d", writer.records, writer.header.RecordCount)
+	}
+	if writer.header.Flags&FLAG_BLOCK_COMPRESSED != 0 {
+		if err := writer.flushBlock(); err != nil {
+			return err
+		}
+		writer.blockIndexOffset = writer.written
+		if err := writer.write(encodeBlockIndex(writer.header, writer.blocks)); err != nil {
+			return fmt.Errorf("write block index error: %w", err)
+		}
+	}
+	if err := writer.writeDirectory(); err != nil {
+		return err
+	}
+	if err := writer.w.Flush(); err != nil {
+		return fmt.Errorf("flush index error: %w", err)
+	}
+	writer.checksum = writer.crc.Sum32()
+	trailer := make([]byte, UINT32_SIZE)
+	writer.header.Order.PutUint32(trailer, writer.checksum)
+	if err := writer.write(trailer); err != nil {
+		return fmt.Errorf("write index checksum error: %w", err)
+	}
+	return writer.w.Flush()
+}
+
+// Checksum returns the trailing checksum written by Close
+func (writer *Writer) Checksum() uint32 {
+	return writer.checksum
+}